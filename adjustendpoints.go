@@ -5,6 +5,7 @@ import (
 	"external-dns-opnsense/opnsense"
 	"log"
 	"net/http"
+	"slices"
 
 	"sigs.k8s.io/external-dns/endpoint"
 )
@@ -35,15 +36,53 @@ func adjustendpointsHandler(w http.ResponseWriter, r *http.Request) {
 
 func AdjustEndpoints(api *opnsense.OpnSenseApi, endpoints []*endpoint.Endpoint) ([]*endpoint.Endpoint, error) {
 	// Pass through only supported record types; do not drop everything.
+	supported := supportedRecordTypes(api)
 	out := make([]*endpoint.Endpoint, 0, len(endpoints))
 	for _, ep := range endpoints {
-		switch ep.RecordType {
-		case endpoint.RecordTypeA, endpoint.RecordTypeAAAA, endpoint.RecordTypeTXT:
-			out = append(out, ep)
-		default:
-			log.Printf("AdjustEndpoints: skipping unsupported record type %s for %s", ep.RecordType, ep.DNSName)
+		if !slices.Contains(supported, ep.RecordType) {
+			log.Printf("AdjustEndpoints: skipping record type %s for %s, not supported by the %s backend", ep.RecordType, ep.DNSName, api.Backend)
+			continue
 		}
+		if api.Backend == opnsense.BackendDnsmasq && ep.RecordTTL.IsConfigured() {
+			// Dnsmasq host overrides have no TTL, the listed records would never match a configured one
+			ep.RecordTTL = 0
+		}
+		if ep.RecordType == endpoint.RecordTypeMX {
+			if err := canonicalizeMXTargets(ep); err != nil {
+				log.Printf("AdjustEndpoints: skipping MX record %s: %v", ep.DNSName, err)
+				continue
+			}
+		}
+		out = append(out, ep)
 	}
 	log.Printf("AdjustEndpoints: accepted %d of %d endpoints", len(out), len(endpoints))
 	return out, nil
 }
+
+// supportedRecordTypes returns the record types the configured backend can store.
+func supportedRecordTypes(api *opnsense.OpnSenseApi) []string {
+	switch api.Backend {
+	case opnsense.BackendDnsmasq:
+		return []string{endpoint.RecordTypeA, endpoint.RecordTypeAAAA}
+	case opnsense.BackendBind:
+		return []string{endpoint.RecordTypeA, endpoint.RecordTypeAAAA, endpoint.RecordTypeTXT, endpoint.RecordTypeCNAME, endpoint.RecordTypeMX,
+			endpoint.RecordTypeSRV, endpoint.RecordTypeNS, endpoint.RecordTypePTR, recordTypeCAA}
+	default:
+		return []string{endpoint.RecordTypeA, endpoint.RecordTypeAAAA, endpoint.RecordTypeTXT, endpoint.RecordTypeCNAME, endpoint.RecordTypeMX}
+	}
+}
+
+// canonicalizeMXTargets checks that every target of an MX endpoint consists of a priority and an exchange,
+// and rewrites them the way the backends list them, so the desired records match the stored ones.
+func canonicalizeMXTargets(ep *endpoint.Endpoint) error {
+	targets := make(endpoint.Targets, 0, len(ep.Targets))
+	for _, target := range ep.Targets {
+		canonical, err := opnsense.CanonicalMXTarget(target)
+		if err != nil {
+			return err
+		}
+		targets = append(targets, canonical)
+	}
+	ep.Targets = targets
+	return nil
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+
+	opnsense "external-dns-opnsense/opnsense"
+
+	"sigs.k8s.io/external-dns/endpoint"
+)
+
+// CreateAliasEntry creates a CNAME endpoint as a host alias attached to the host override of its target.
+func CreateAliasEntry(api *opnsense.OpnSenseApi, ep *endpoint.Endpoint) error {
+	if len(ep.Targets) != 1 {
+		return fmt.Errorf("CreateAliasEntry: CNAME %s needs exactly one target, got %d", ep.DNSName, len(ep.Targets))
+	}
+	hostname, domain, err := api.SplitDNSName(ep.DNSName)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), api.ApiTimeout)
+	defer cancel()
+	parent, err := resolveAliasParent(api.WithContext(ctx), ep.Targets[0])
+	if err != nil {
+		log.Printf("CreateAliasEntry: Error resolving parent override for %s: %v\n", ep.DNSName, err)
+		return err
+	}
+	alias := opnsense.OpnSenseHostAlias{
+		Enabled:     "1",
+		Host:        parent,
+		HostName:    hostname,
+		Domain:      domain,
+		Description: api.Description(ep.Labels[endpoint.ResourceLabelKey], endpoint.RecordTypeCNAME),
+	}
+	log.Printf("CreateAliasEntry: Creating host alias: %+v\n", alias)
+	err = alias.Create(api.WithContext(ctx))
+	if err != nil {
+		log.Printf("CreateAliasEntry: Error creating host alias: %v\n", err)
+		return err
+	}
+	return nil
+}
+
+// UpdateAliasEntry points the host alias identified by the uuid label of old to the host override of the target of ep.
+func UpdateAliasEntry(api *opnsense.OpnSenseApi, old, ep *endpoint.Endpoint) error {
+	if old == nil || old.Labels["uuid"] == "" {
+		return fmt.Errorf("UpdateAliasEntry: no existing alias known for %s", ep.DNSName)
+	}
+	if len(ep.Targets) != 1 {
+		return fmt.Errorf("UpdateAliasEntry: CNAME %s needs exactly one target, got %d", ep.DNSName, len(ep.Targets))
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), api.ApiTimeout)
+	defer cancel()
+	alias := opnsense.OpnSenseHostAlias{
+		Uuid: old.Labels["uuid"],
+	}
+	err := alias.GetByUUID(api.WithContext(ctx))
+	if err != nil {
+		log.Printf("UpdateAliasEntry: Error finding existing alias with id %s: %v\n", alias.Uuid, err)
+		return err
+	}
+	if err := api.CheckOwnership(ep.DNSName, alias.Description); err != nil {
+		log.Printf("UpdateAliasEntry: Refusing to update host alias: %v\n", err)
+		return err
+	}
+	parent, err := resolveAliasParent(api.WithContext(ctx), ep.Targets[0])
+	if err != nil {
+		log.Printf("UpdateAliasEntry: Error resolving parent override for %s: %v\n", ep.DNSName, err)
+		return err
+	}
+	description := api.Description(ep.Labels[endpoint.ResourceLabelKey], endpoint.RecordTypeCNAME)
+	if alias.Host == parent && alias.Description == description {
+		log.Printf("UpdateAliasEntry: Host alias %s already points to %s\n", alias.Uuid, ep.Targets[0])
+		return nil
+	}
+	alias.Host = parent
+	alias.Description = description
+	log.Printf("UpdateAliasEntry: Updating host alias: %+v\n", alias)
+	err = alias.Update(api.WithContext(ctx))
+	if err != nil {
+		log.Printf("UpdateAliasEntry: Error updating host alias: %v\n", err)
+		return err
+	}
+	return nil
+}
+
+// DeleteAliasEntry deletes the host alias identified by the uuid label of the endpoint.
+// The parent host override is left untouched, as other aliases may still point to it.
+func DeleteAliasEntry(api *opnsense.OpnSenseApi, ep *endpoint.Endpoint) error {
+	hostname, domain, err := api.SplitDNSName(ep.DNSName)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), api.ApiTimeout)
+	defer cancel()
+	alias := opnsense.OpnSenseHostAlias{
+		Uuid: ep.Labels["uuid"],
+	}
+	err = alias.GetByUUID(api.WithContext(ctx))
+	if err != nil {
+		log.Printf("DeleteAliasEntry: Error finding existing alias with id %s: %v\n", alias.Uuid, err)
+		return err
+	}
+	if hostname != alias.HostName || domain != alias.Domain {
+		return fmt.Errorf("DeleteAliasEntry: Alias does not match with expected Value. Alias: %s.%s, Expected: %s", alias.HostName, alias.Domain, ep.DNSName)
+	}
+	if err := api.CheckOwnership(ep.DNSName, alias.Description); err != nil {
+		log.Printf("DeleteAliasEntry: Refusing to delete host alias: %v\n", err)
+		return err
+	}
+	log.Printf("DeleteAliasEntry: Deleting host alias: %+v\n", alias)
+	err = alias.Delete(api.WithContext(ctx))
+	if err != nil {
+		log.Printf("DeleteAliasEntry: Error deleting host alias: %v\n", err)
+		return err
+	}
+	return nil
+}
+
+// resolveAliasParent returns the UUID of the A or AAAA host override named target.
+// Unbound can only alias host overrides, so a target without one fails with opnsense.ErrAliasTargetNotFound.
+// If the target is created in the same or a later sync, the next sync of external-dns creates the alias.
+func resolveAliasParent(api *opnsense.OpnSenseApi, target string) (string, error) {
+	target = strings.TrimSuffix(target, ".")
+	hostname, domain, err := api.SplitDNSName(target)
+	if err != nil {
+		return "", err
+	}
+	parent, err := opnsense.FindHostOverrideByName(api, hostname, domain)
+	if err != nil {
+		return "", err
+	}
+	if parent == nil {
+		return "", fmt.Errorf("%w: %s", opnsense.ErrAliasTargetNotFound, target)
+	}
+	return parent.Uuid, nil
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	opnsense "external-dns-opnsense/opnsense"
+
+	"sigs.k8s.io/external-dns/endpoint"
+)
+
+// Backend manages the DNS records of one DNS service on OpnSense.
+// Records are exchanged as endpoints; backends keep the identifiers of the
+// underlying entries in the uuid label, so updates and deletes can find them again.
+type Backend interface {
+	// List returns all records of the service, labeled with their owner.
+	List() ([]*endpoint.Endpoint, error)
+	// Create adds the records of ep.
+	Create(ep *endpoint.Endpoint) error
+	// Update changes the records of old, as previously listed, to match ep.
+	Update(old, ep *endpoint.Endpoint) error
+	// Delete removes the records of ep, as previously listed.
+	Delete(ep *endpoint.Endpoint) error
+	// Commit activates all changes made since the last commit.
+	Commit() error
+}
+
+// NewBackend returns the backend configured for api.
+func NewBackend(api *opnsense.OpnSenseApi) Backend {
+	switch api.Backend {
+	case opnsense.BackendDnsmasq:
+		return &dnsmasqBackend{api: api}
+	case opnsense.BackendBind:
+		return &bindBackend{api: api}
+	default:
+		return &unboundBackend{api: api}
+	}
+}
@@ -0,0 +1,480 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+	"unicode/utf8"
+
+	opnsense "external-dns-opnsense/opnsense"
+
+	"sigs.k8s.io/external-dns/endpoint"
+)
+
+// recordTypeCAA is not defined by external-dns, but can be stored in BIND zones.
+const recordTypeCAA = "CAA"
+
+// bindBackend manages records inside the primary zones of the BIND plugin (os-bind).
+// Every target is stored as its own record in the zone with the longest matching name.
+// BIND records carry no description, so the ownership of every name and record type is kept
+// in a TXT marker record, which holds the structured description as text. Like the TXT registry
+// of external-dns, the marker is stored at a prefixed name, see bindMarkerName, as a CNAME does
+// not allow other records next to it.
+type bindBackend struct {
+	api   *opnsense.OpnSenseApi
+	zones []*opnsense.BindZone
+}
+
+// bindMarkerPrefix starts the names of ownership markers, followed by the lower case record type.
+const bindMarkerPrefix = "_extdns-"
+
+// bindRecordSet holds the records of one name and record type in a zone, and their ownership marker.
+// legacyMarker is a marker written by earlier versions next to the records, it is replaced by marker once written.
+type bindRecordSet struct {
+	records      []*opnsense.BindRecord
+	marker       *opnsense.BindRecord
+	legacyMarker *opnsense.BindRecord
+}
+
+// description returns the description stored in the ownership marker, or an empty string if there is none.
+func (set *bindRecordSet) description() string {
+	switch {
+	case set.marker != nil:
+		return bindTarget(endpoint.RecordTypeTXT, set.marker.Value)
+	case set.legacyMarker != nil:
+		return bindTarget(endpoint.RecordTypeTXT, set.legacyMarker.Value)
+	default:
+		return ""
+	}
+}
+
+func (b *bindBackend) List() ([]*endpoint.Endpoint, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), b.api.ApiTimeout)
+	defer cancel()
+	api := b.api.WithContext(ctx)
+	zones, err := b.loadZones(api)
+	if err != nil {
+		log.Printf("List: Error retrieving BIND zones: %v\n", err)
+		return nil, err
+	}
+	records, err := opnsense.SearchBindRecords(api, "")
+	if err != nil {
+		log.Printf("List: Error retrieving BIND records: %v\n", err)
+		return nil, err
+	}
+
+	// Group the records into one endpoint per name and type, the markers hold the ownership of each group
+	endpoints := []*endpoint.Endpoint{}
+	grouped := map[string]*endpoint.Endpoint{}
+	markers := map[string]string{}
+	legacyMarkers := map[string]string{}
+	for _, r := range records {
+		zone := findBindZone(zones, r.Domain)
+		if zone == nil {
+			continue
+		}
+		name := bindFQDN(zone, r.Name)
+		if isBindMarker(r) {
+			description := bindTarget(endpoint.RecordTypeTXT, r.Value)
+			if owner, ok := bindMarkerOwner(r.Name); ok {
+				markers[bindFQDN(zone, owner)+"/"+opnsense.ParseDescription(description).Type] = description
+			} else {
+				legacyMarkers[name+"/"+opnsense.ParseDescription(description).Type] = description
+			}
+			continue
+		}
+		key := name + "/" + r.Type
+		if ep, ok := grouped[key]; ok {
+			ep.Targets = append(ep.Targets, bindTarget(r.Type, r.Value))
+			ep.Labels["uuid"] += "," + r.Uuid
+			continue
+		}
+		ep := &endpoint.Endpoint{
+			DNSName:    name,
+			RecordType: r.Type,
+			Targets:    []string{bindTarget(r.Type, r.Value)},
+			Labels:     map[string]string{"uuid": r.Uuid},
+		}
+		grouped[key] = ep
+		endpoints = append(endpoints, ep)
+	}
+	for key, ep := range grouped {
+		description, ok := markers[key]
+		if !ok {
+			description = legacyMarkers[key]
+		}
+		for k, v := range descriptionLabels(description) {
+			ep.Labels[k] = v
+		}
+	}
+	return endpoints, nil
+}
+
+func (b *bindBackend) Create(ep *endpoint.Endpoint) error {
+	log.Printf("Creating BIND entry: %s %s %v\n", ep.DNSName, ep.RecordType, ep.Targets)
+	ctx, cancel := context.WithTimeout(context.Background(), b.api.ApiTimeout)
+	defer cancel()
+	api := b.api.WithContext(ctx)
+	zone, name, err := b.zoneOf(api, ep.DNSName)
+	if err != nil {
+		return err
+	}
+	set, err := b.lookup(api, zone, name, ep.RecordType, nil)
+	if err != nil {
+		log.Printf("CreateEntry: Error searching existing BIND records: %v\n", err)
+		return err
+	}
+	if len(set.records) > 0 || set.description() != "" {
+		if err := b.api.CheckOwnership(ep.DNSName, set.description()); err != nil {
+			log.Printf("CreateEntry: Refusing to update BIND records: %v\n", err)
+			return err
+		}
+	}
+
+	for _, target := range ep.Targets {
+		value := bindValue(ep.RecordType, target)
+		if slices.ContainsFunc(set.records, func(r *opnsense.BindRecord) bool { return r.Value == value }) {
+			continue
+		}
+		record := &opnsense.BindRecord{Enabled: "1", Domain: zone.Uuid, Name: name, Type: ep.RecordType, Value: value}
+		if err := record.Add(api); err != nil {
+			log.Printf("CreateEntry: Error creating BIND record: %v\n", err)
+			return err
+		}
+	}
+	return b.writeMarker(api, zone, name, ep.RecordType, set, b.api.Description(ep.Labels[endpoint.ResourceLabelKey], ep.RecordType))
+}
+
+// Update writes the targets of ep to the records referenced by the uuid label of old.
+// Records of unchanged targets are kept, records of removed targets are reused for added targets.
+func (b *bindBackend) Update(old, ep *endpoint.Endpoint) error {
+	log.Printf("Updating BIND entry: %s %s %v\n", ep.DNSName, ep.RecordType, ep.Targets)
+	ctx, cancel := context.WithTimeout(context.Background(), b.api.ApiTimeout)
+	defer cancel()
+	api := b.api.WithContext(ctx)
+	zone, name, err := b.zoneOf(api, ep.DNSName)
+	if err != nil {
+		return err
+	}
+	set, err := b.lookup(api, zone, name, ep.RecordType, old)
+	if err != nil {
+		log.Printf("UpdateEntry: Error finding existing BIND records: %v\n", err)
+		return err
+	}
+	if err := b.api.CheckOwnership(ep.DNSName, set.description()); err != nil {
+		log.Printf("UpdateEntry: Refusing to update BIND records: %v\n", err)
+		return err
+	}
+
+	values := make([]string, 0, len(ep.Targets))
+	for _, target := range ep.Targets {
+		values = append(values, bindValue(ep.RecordType, target))
+	}
+	unmatched := []*opnsense.BindRecord{}
+	existing := map[string]bool{}
+	for _, r := range set.records {
+		if slices.Contains(values, r.Value) {
+			existing[r.Value] = true
+		} else {
+			unmatched = append(unmatched, r)
+		}
+	}
+	for _, value := range values {
+		if existing[value] {
+			continue
+		}
+		record := &opnsense.BindRecord{Enabled: "1", Domain: zone.Uuid, Name: name, Type: ep.RecordType, Value: value}
+		if len(unmatched) > 0 {
+			record.Uuid, unmatched = unmatched[0].Uuid, unmatched[1:]
+			err = record.Update(api)
+		} else {
+			err = record.Add(api)
+		}
+		if err != nil {
+			log.Printf("UpdateEntry: Error updating BIND record: %v\n", err)
+			return err
+		}
+	}
+	for _, record := range unmatched {
+		if err := record.Delete(api); err != nil {
+			log.Printf("UpdateEntry: Error deleting BIND record: %v\n", err)
+			return err
+		}
+	}
+	return b.writeMarker(api, zone, name, ep.RecordType, set, b.api.Description(ep.Labels[endpoint.ResourceLabelKey], ep.RecordType))
+}
+
+// Delete removes the records referenced by the uuid label of ep, and their ownership marker.
+func (b *bindBackend) Delete(ep *endpoint.Endpoint) error {
+	log.Printf("Deleting BIND entry: %s %s %v %v\n", ep.DNSName, ep.RecordType, ep.Targets, ep.Labels)
+	ctx, cancel := context.WithTimeout(context.Background(), b.api.ApiTimeout)
+	defer cancel()
+	api := b.api.WithContext(ctx)
+	zone, name, err := b.zoneOf(api, ep.DNSName)
+	if err != nil {
+		return err
+	}
+	set, err := b.lookup(api, zone, name, ep.RecordType, ep)
+	if err != nil {
+		log.Printf("DeleteEntry: Error finding existing BIND records: %v\n", err)
+		return err
+	}
+	if err := b.api.CheckOwnership(ep.DNSName, set.description()); err != nil {
+		log.Printf("DeleteEntry: Refusing to delete BIND records: %v\n", err)
+		return err
+	}
+	for _, record := range set.records {
+		if err := record.Delete(api); err != nil {
+			log.Printf("DeleteEntry: Error deleting BIND record: %v\n", err)
+			return err
+		}
+	}
+	for _, marker := range []*opnsense.BindRecord{set.marker, set.legacyMarker} {
+		if marker == nil {
+			continue
+		}
+		if err := marker.Delete(api); err != nil {
+			log.Printf("DeleteEntry: Error deleting BIND ownership marker: %v\n", err)
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *bindBackend) Commit() error {
+	return b.api.Commit("bind")
+}
+
+// loadZones returns the enabled primary zones, which are only fetched once per backend.
+func (b *bindBackend) loadZones(api *opnsense.OpnSenseApi) ([]*opnsense.BindZone, error) {
+	if b.zones != nil {
+		return b.zones, nil
+	}
+	zones, err := opnsense.SearchBindZones(api)
+	if err != nil {
+		return nil, err
+	}
+	b.zones = []*opnsense.BindZone{}
+	for _, zone := range zones {
+		if zone.Enabled != "0" {
+			b.zones = append(b.zones, zone)
+		}
+	}
+	return b.zones, nil
+}
+
+// zoneOf returns the primary zone with the longest name the DNS name belongs to, and the name relative to it.
+func (b *bindBackend) zoneOf(api *opnsense.OpnSenseApi, dnsName string) (*opnsense.BindZone, string, error) {
+	zones, err := b.loadZones(api)
+	if err != nil {
+		return nil, "", err
+	}
+	dnsName = strings.ToLower(strings.TrimSuffix(dnsName, "."))
+	var match *opnsense.BindZone
+	for _, zone := range zones {
+		zoneName := strings.ToLower(strings.TrimSuffix(zone.DomainName, "."))
+		if match != nil && len(zoneName) <= len(strings.TrimSuffix(match.DomainName, ".")) {
+			continue
+		}
+		if dnsName == zoneName || strings.HasSuffix(dnsName, "."+zoneName) {
+			match = zone
+		}
+	}
+	if match == nil {
+		return nil, "", fmt.Errorf("DNS name %s does not belong to any BIND primary zone", dnsName)
+	}
+	zoneName := strings.ToLower(strings.TrimSuffix(match.DomainName, "."))
+	if dnsName == zoneName {
+		return match, "@", nil
+	}
+	return match, strings.TrimSuffix(dnsName, "."+zoneName), nil
+}
+
+// lookup returns the records of name and recordType in zone, and their ownership marker.
+// If ep carries a uuid label, only the records listed in it are returned.
+// The search for name also finds the marker, whose name ends with name.
+func (b *bindBackend) lookup(api *opnsense.OpnSenseApi, zone *opnsense.BindZone, name, recordType string, ep *endpoint.Endpoint) (*bindRecordSet, error) {
+	searchPhrase := name
+	if name == "@" {
+		searchPhrase = ""
+	}
+	records, err := opnsense.SearchBindRecords(api, searchPhrase)
+	if err != nil {
+		return nil, err
+	}
+	uuids := []string{}
+	if ep != nil && ep.Labels["uuid"] != "" {
+		uuids = strings.Split(ep.Labels["uuid"], ",")
+	}
+	markerName := bindMarkerName(name, recordType)
+	set := &bindRecordSet{}
+	for _, r := range records {
+		if findBindZone([]*opnsense.BindZone{zone}, r.Domain) == nil {
+			continue
+		}
+		switch {
+		case strings.EqualFold(r.Name, markerName):
+			if isBindMarker(r) {
+				set.marker = r
+			}
+		case !strings.EqualFold(r.Name, name):
+			continue
+		case isBindMarker(r):
+			if opnsense.ParseDescription(bindTarget(endpoint.RecordTypeTXT, r.Value)).Type == recordType {
+				set.legacyMarker = r
+			}
+		case r.Type == recordType && (len(uuids) == 0 || slices.Contains(uuids, r.Uuid)):
+			set.records = append(set.records, r)
+		}
+	}
+	return set, nil
+}
+
+// writeMarker stores description in the ownership marker of the record set of name and recordType,
+// creating the marker if needed. A legacy marker next to the records is removed.
+func (b *bindBackend) writeMarker(api *opnsense.OpnSenseApi, zone *opnsense.BindZone, name, recordType string, set *bindRecordSet, description string) error {
+	value := bindValue(endpoint.RecordTypeTXT, description)
+	var err error
+	switch {
+	case set.marker == nil:
+		marker := &opnsense.BindRecord{Enabled: "1", Domain: zone.Uuid, Name: bindMarkerName(name, recordType), Type: endpoint.RecordTypeTXT, Value: value}
+		err = marker.Add(api)
+	case set.marker.Value != value:
+		set.marker.Value = value
+		err = set.marker.Update(api)
+	}
+	if err != nil || set.legacyMarker == nil {
+		return err
+	}
+	log.Printf("Moving the BIND ownership marker of %s %s to %s\n", name, recordType, bindMarkerName(name, recordType))
+	return set.legacyMarker.Delete(api)
+}
+
+// bindMarkerName returns the name of the ownership marker of the records of name and recordType,
+// e.g. _extdns-cname.www for the CNAME www and _extdns-mx for the MX records of the zone apex.
+func bindMarkerName(name, recordType string) string {
+	prefix := bindMarkerPrefix + strings.ToLower(recordType)
+	if name == "@" || name == "" {
+		return prefix
+	}
+	return prefix + "." + name
+}
+
+// bindMarkerOwner returns the name of the records an ownership marker named name belongs to,
+// and false if name is no marker name.
+func bindMarkerOwner(name string) (string, bool) {
+	if !strings.HasPrefix(strings.ToLower(name), bindMarkerPrefix) {
+		return "", false
+	}
+	_, owner, found := strings.Cut(name, ".")
+	if !found {
+		return "@", true
+	}
+	return owner, true
+}
+
+// findBindZone returns the zone referenced by ref, which search results return either as UUID or as zone name.
+func findBindZone(zones []*opnsense.BindZone, ref string) *opnsense.BindZone {
+	for _, zone := range zones {
+		if zone.Uuid == ref || strings.EqualFold(zone.DomainName, ref) {
+			return zone
+		}
+	}
+	return nil
+}
+
+// isBindMarker reports whether the record is an ownership marker of this webhook.
+func isBindMarker(record *opnsense.BindRecord) bool {
+	return record.Type == endpoint.RecordTypeTXT && opnsense.IsManagedDescription(bindTarget(endpoint.RecordTypeTXT, record.Value))
+}
+
+// bindFQDN returns the DNS name of a record name relative to zone.
+func bindFQDN(zone *opnsense.BindZone, name string) string {
+	zoneName := strings.TrimSuffix(zone.DomainName, ".")
+	if name == "@" || name == "" {
+		return zoneName
+	}
+	return name + "." + zoneName
+}
+
+// bindTXTStringLength is the maximum length of a single character string in TXT data.
+const bindTXTStringLength = 255
+
+// bindTXTEscaper escapes TXT data inside a quoted character string.
+var bindTXTEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`)
+
+// bindValue converts an endpoint target into record data in zone file syntax.
+// TXT data is quoted, split into strings of at most 255 bytes, and host names are made absolute.
+func bindValue(recordType, target string) string {
+	switch recordType {
+	case endpoint.RecordTypeTXT:
+		quoted := []string{}
+		for _, chunk := range splitTXT(target) {
+			quoted = append(quoted, `"`+bindTXTEscaper.Replace(chunk)+`"`)
+		}
+		return strings.Join(quoted, " ")
+	case endpoint.RecordTypeCNAME, endpoint.RecordTypeNS, endpoint.RecordTypePTR, endpoint.RecordTypeMX, endpoint.RecordTypeSRV:
+		// The host name is the last field of the record data
+		fields := strings.Fields(target)
+		if len(fields) == 0 {
+			return target
+		}
+		fields[len(fields)-1] = strings.TrimSuffix(fields[len(fields)-1], ".") + "."
+		return strings.Join(fields, " ")
+	default:
+		return target
+	}
+}
+
+// bindTarget converts record data in zone file syntax back into an endpoint target, reversing bindValue.
+func bindTarget(recordType, value string) string {
+	switch recordType {
+	case endpoint.RecordTypeTXT:
+		return joinTXT(value)
+	case endpoint.RecordTypeCNAME, endpoint.RecordTypeNS, endpoint.RecordTypePTR, endpoint.RecordTypeMX, endpoint.RecordTypeSRV:
+		return strings.TrimSuffix(strings.Join(strings.Fields(value), " "), ".")
+	default:
+		return value
+	}
+}
+
+// splitTXT splits TXT data into character strings of at most bindTXTStringLength bytes, without splitting characters.
+func splitTXT(data string) []string {
+	chunks := []string{}
+	for len(data) > bindTXTStringLength {
+		cut := bindTXTStringLength
+		for cut > 0 && !utf8.RuneStart(data[cut]) {
+			cut--
+		}
+		chunks = append(chunks, data[:cut])
+		data = data[cut:]
+	}
+	return append(chunks, data)
+}
+
+// joinTXT returns the TXT data of record data holding one or more quoted character strings, reversing the
+// quoting and splitting of bindValue. Data that is not quoted is returned as is.
+func joinTXT(value string) string {
+	value = strings.TrimSpace(value)
+	if !strings.HasPrefix(value, `"`) {
+		return value
+	}
+	var data strings.Builder
+	quoted, escaped := false, false
+	for _, r := range value {
+		switch {
+		case escaped:
+			data.WriteRune(r)
+			escaped = false
+		case quoted && r == '\\':
+			escaped = true
+		case r == '"':
+			quoted = !quoted
+		case quoted:
+			data.WriteRune(r)
+		}
+	}
+	return data.String()
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	opnsense "external-dns-opnsense/opnsense"
+
+	"sigs.k8s.io/external-dns/endpoint"
+	"sigs.k8s.io/external-dns/plan"
+)
+
+func TestBindCNAMEAlone(t *testing.T) {
+	p, srv := newWebhookProvider(t, opnsense.BackendBind)
+	srv.AddBindZone("example.com")
+	cname := endpoint.NewEndpoint("web.example.com", endpoint.RecordTypeCNAME, "www.example.com")
+	// The description of the marker exceeds a single TXT string
+	resource := "ingress/default/" + strings.Repeat("web", 100)
+	cname.Labels[endpoint.ResourceLabelKey] = resource
+	if errs := ApplyChanges(NewBackend(api), plan.Changes{Create: []*endpoint.Endpoint{cname}}); len(errs) != 0 {
+		t.Fatalf("ApplyChanges returned %v", errs)
+	}
+
+	// named refuses a zone with a CNAME and other data at the same name
+	for _, r := range srv.BindRecords() {
+		if strings.EqualFold(r.Name, "web") && r.Type != endpoint.RecordTypeCNAME {
+			t.Errorf("%s record %s stored next to the CNAME", r.Type, r.Value)
+		}
+	}
+	listed := recordsByName(t, p)["web.example.com CNAME"]
+	if listed == nil || listed.Labels[endpoint.OwnerLabelKey] != api.OwnerID || listed.Labels[endpoint.ResourceLabelKey] != resource {
+		t.Fatalf("web.example.com CNAME is listed as %v", listed)
+	}
+
+	if errs := ApplyChanges(NewBackend(api), plan.Changes{Delete: []*endpoint.Endpoint{listed}}); len(errs) != 0 {
+		t.Fatalf("ApplyChanges returned %v", errs)
+	}
+	if records := srv.BindRecords(); len(records) != 0 {
+		t.Errorf("records %v left after the delete", records)
+	}
+}
+
+func TestBindLegacyMarker(t *testing.T) {
+	p, srv := newWebhookProvider(t, opnsense.BackendBind)
+	zone := srv.AddBindZone("example.com")
+	client := srv.Api()
+	for _, r := range []*opnsense.BindRecord{
+		{Enabled: "1", Domain: zone, Name: "www", Type: endpoint.RecordTypeA, Value: "192.0.2.1"},
+		{Enabled: "1", Domain: zone, Name: "www", Type: endpoint.RecordTypeTXT, Value: bindValue(endpoint.RecordTypeTXT, api.Description("", endpoint.RecordTypeA))},
+	} {
+		if err := r.Add(client); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Markers of earlier versions next to the records are still honored, and moved on the next write
+	www := recordsByName(t, p)["www.example.com A"]
+	if www == nil || www.Labels[endpoint.OwnerLabelKey] != api.OwnerID {
+		t.Fatalf("www.example.com A is listed as %v", www)
+	}
+	updated := www.DeepCopy()
+	updated.Targets = endpoint.Targets{"192.0.2.2"}
+	if errs := ApplyChanges(NewBackend(api), plan.Changes{UpdateOld: []*endpoint.Endpoint{www}, UpdateNew: []*endpoint.Endpoint{updated}}); len(errs) != 0 {
+		t.Fatalf("ApplyChanges returned %v", errs)
+	}
+	names := []string{}
+	for _, r := range srv.BindRecords() {
+		names = append(names, r.Name+" "+r.Type)
+	}
+	if strings.Join(names, ", ") != "www A, _extdns-a.www TXT" {
+		t.Errorf("stored records are %v, want the A record and the prefixed marker", names)
+	}
+}
+
+func TestBindTXTValue(t *testing.T) {
+	tests := []struct {
+		name    string
+		target  string
+		strings int
+	}{
+		{"short", "heritage=external-dns", 1},
+		{"quotes and backslashes", `say "hi" \o/`, 1},
+		{"empty", "", 1},
+		{"exactly 255 bytes", strings.Repeat("a", 255), 1},
+		{"long", strings.Repeat("a", 600), 3},
+		{"multibyte characters", strings.Repeat("ä", 200), 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			value := bindValue(endpoint.RecordTypeTXT, tt.target)
+			if got := bindTarget(endpoint.RecordTypeTXT, value); got != tt.target {
+				t.Errorf("bindTarget(%q) = %q, want %q", value, got, tt.target)
+			}
+			chunks := splitTXT(tt.target)
+			if len(chunks) != tt.strings {
+				t.Errorf("split into %d strings, want %d", len(chunks), tt.strings)
+			}
+			for _, chunk := range chunks {
+				if len(chunk) > 255 {
+					t.Errorf("string of %d bytes", len(chunk))
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,387 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"maps"
+	"slices"
+	"strings"
+
+	opnsense "external-dns-opnsense/opnsense"
+
+	"sigs.k8s.io/external-dns/endpoint"
+)
+
+// dnsmasqBackend manages Dnsmasq host overrides. Like Unbound, every target is stored as its own
+// host override. Dnsmasq host overrides only carry addresses, so only A and AAAA records are supported.
+// The TXT records of the external-dns TXT registry are skipped, see isRegistryRecord.
+type dnsmasqBackend struct {
+	api *opnsense.OpnSenseApi
+}
+
+func (b *dnsmasqBackend) List() ([]*endpoint.Endpoint, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), b.api.ApiTimeout)
+	defer cancel()
+	hosts, err := opnsense.SearchDnsmasqHosts(b.api.WithContext(ctx), "")
+	if err != nil {
+		log.Printf("List: Error retrieving dnsmasq host overrides: %v\n", err)
+		return nil, err
+	}
+	// Group the host overrides back into one endpoint per name, type and owner
+	endpoints := []*endpoint.Endpoint{}
+	grouped := map[string]*endpoint.Endpoint{}
+	for _, h := range hosts {
+		labels := descriptionLabels(h.Description)
+		// Manually created overrides may hold several addresses
+		for _, ip := range h.Addresses() {
+			recordType := opnsense.AddressType(ip)
+			name := opnsense.JoinDNSName(h.HostName, h.Domain)
+			key := name + "/" + recordType + "/" + labels[endpoint.OwnerLabelKey]
+			if ep, ok := grouped[key]; ok {
+				ep.Targets = append(ep.Targets, ip)
+				if !slices.Contains(strings.Split(ep.Labels["uuid"], ","), h.Uuid) {
+					ep.Labels["uuid"] += "," + h.Uuid
+				}
+				continue
+			}
+			epLabels := map[string]string{"uuid": h.Uuid}
+			for k, v := range labels {
+				epLabels[k] = v
+			}
+			ep := &endpoint.Endpoint{
+				DNSName:    name,
+				RecordType: recordType,
+				Targets:    []string{ip},
+				Labels:     epLabels,
+			}
+			grouped[key] = ep
+			endpoints = append(endpoints, ep)
+		}
+	}
+	return endpoints, nil
+}
+
+func (b *dnsmasqBackend) Create(ep *endpoint.Endpoint) error {
+	log.Printf("Creating dnsmasq entry: %s %s %v\n", ep.DNSName, ep.RecordType, ep.Targets)
+	if isRegistryRecord(ep) {
+		return nil
+	}
+	if err := checkDnsmasqRecordType(ep); err != nil {
+		return err
+	}
+	hostname, domain, err := b.api.SplitDNSName(ep.DNSName)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), b.api.ApiTimeout)
+	defer cancel()
+	existing, err := b.findHosts(b.api.WithContext(ctx), hostname, domain, ep.RecordType)
+	if err != nil {
+		log.Printf("CreateEntry: Error searching existing dnsmasq host overrides: %v\n", err)
+		return err
+	}
+
+	// Adding an address to an existing name takes it over as well, so every override of it must be ours to touch
+	for _, found := range existing {
+		if err := b.api.CheckOwnership(ep.DNSName, found.Description); err != nil {
+			log.Printf("CreateEntry: Refusing to change dnsmasq host overrides: %v\n", err)
+			return err
+		}
+	}
+
+	description := b.api.Description(ep.Labels[endpoint.ResourceLabelKey], ep.RecordType)
+	for _, target := range ep.Targets {
+		found, ok := existing[target]
+		if !ok {
+			host := &opnsense.DnsmasqHost{
+				HostName:    hostname,
+				Domain:      domain,
+				Ip:          target,
+				Description: description,
+			}
+			if err := host.Add(b.api.WithContext(ctx)); err != nil {
+				log.Printf("CreateEntry: Error creating dnsmasq host override: %v\n", err)
+				return err
+			}
+			continue
+		}
+		// The description of an override also holding addresses of the other type is left alone
+		if found.Description == description || !holdsOnly(found, ep.RecordType) {
+			continue
+		}
+		host := *found
+		host.Description = description
+		if err := host.Update(b.api.WithContext(ctx)); err != nil {
+			log.Printf("CreateEntry: Error updating dnsmasq host override: %v\n", err)
+			return err
+		}
+		// Further addresses of the same override need no write
+		found.Description = description
+	}
+	return nil
+}
+
+// Update writes the targets and description of ep to the host overrides referenced by the uuid label of old.
+// Addresses of unchanged targets are kept, addresses of removed targets are reused for added targets.
+// Addresses of the other record type in the same override are left untouched.
+func (b *dnsmasqBackend) Update(old, ep *endpoint.Endpoint) error {
+	log.Printf("Updating dnsmasq entry: %s %s %v\n", ep.DNSName, ep.RecordType, ep.Targets)
+	if isRegistryRecord(ep) {
+		return nil
+	}
+	if err := checkDnsmasqRecordType(ep); err != nil {
+		return err
+	}
+	hostname, domain, err := b.api.SplitDNSName(ep.DNSName)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), b.api.ApiTimeout)
+	defer cancel()
+	var existing map[string]*opnsense.DnsmasqHost
+	if old == nil || old.Labels["uuid"] == "" {
+		existing, err = b.findHosts(b.api.WithContext(ctx), hostname, domain, ep.RecordType)
+	} else {
+		existing, err = b.currentHosts(b.api.WithContext(ctx), old, hostname, domain)
+	}
+	if err != nil {
+		log.Printf("UpdateEntry: Error finding existing dnsmasq host overrides: %v\n", err)
+		return err
+	}
+	for _, host := range existing {
+		if err := b.api.CheckOwnership(ep.DNSName, host.Description); err != nil {
+			log.Printf("UpdateEntry: Refusing to update dnsmasq host override: %v\n", err)
+			return err
+		}
+	}
+
+	unmatched := []string{}
+	for ip := range existing {
+		if !slices.Contains(ep.Targets, ip) {
+			unmatched = append(unmatched, ip)
+		}
+	}
+	slices.Sort(unmatched)
+	description := b.api.Description(ep.Labels[endpoint.ResourceLabelKey], ep.RecordType)
+	edit := newDnsmasqEdit(existing)
+	for _, target := range ep.Targets {
+		if _, ok := existing[target]; ok {
+			continue
+		}
+		if len(unmatched) > 0 {
+			edit.replace(existing[unmatched[0]], unmatched[0], target)
+			unmatched = unmatched[1:]
+			continue
+		}
+		host := &opnsense.DnsmasqHost{
+			HostName:    hostname,
+			Domain:      domain,
+			Ip:          target,
+			Description: description,
+		}
+		if err := host.Add(b.api.WithContext(ctx)); err != nil {
+			log.Printf("UpdateEntry: Error creating dnsmasq host override: %v\n", err)
+			return err
+		}
+	}
+	for _, ip := range unmatched {
+		edit.remove(existing[ip], ip)
+	}
+	if err := edit.write(b.api.WithContext(ctx), ep.RecordType, description); err != nil {
+		log.Printf("UpdateEntry: Error updating dnsmasq host override: %v\n", err)
+		return err
+	}
+	return nil
+}
+
+// Delete removes the addresses of ep from the host overrides referenced by its uuid label, or without one,
+// from the host overrides of its name holding them. Overrides left without addresses are deleted.
+func (b *dnsmasqBackend) Delete(ep *endpoint.Endpoint) error {
+	log.Printf("Deleting dnsmasq entry: %s %s %v %v\n", ep.DNSName, ep.RecordType, ep.Targets, ep.Labels)
+	if isRegistryRecord(ep) {
+		return nil
+	}
+	if err := checkDnsmasqRecordType(ep); err != nil {
+		return err
+	}
+	hostname, domain, err := b.api.SplitDNSName(ep.DNSName)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), b.api.ApiTimeout)
+	defer cancel()
+	var existing map[string]*opnsense.DnsmasqHost
+	if ep.Labels["uuid"] == "" {
+		existing, err = b.findHosts(b.api.WithContext(ctx), hostname, domain, ep.RecordType)
+		maps.DeleteFunc(existing, func(ip string, _ *opnsense.DnsmasqHost) bool { return !slices.Contains(ep.Targets, ip) })
+	} else {
+		existing, err = b.currentHosts(b.api.WithContext(ctx), ep, hostname, domain)
+	}
+	if err != nil {
+		log.Printf("DeleteEntry: Error finding existing dnsmasq host overrides: %v\n", err)
+		return err
+	}
+	edit := newDnsmasqEdit(existing)
+	for ip, host := range existing {
+		if err := b.api.CheckOwnership(ep.DNSName, host.Description); err != nil {
+			log.Printf("DeleteEntry: Refusing to delete dnsmasq host override: %v\n", err)
+			return err
+		}
+		edit.remove(host, ip)
+	}
+	if err := edit.write(b.api.WithContext(ctx), ep.RecordType, ""); err != nil {
+		log.Printf("DeleteEntry: Error deleting dnsmasq host override: %v\n", err)
+		return err
+	}
+	return nil
+}
+
+func (b *dnsmasqBackend) Commit() error {
+	return b.api.Commit("dnsmasq")
+}
+
+// findHosts returns the host overrides of the given name holding addresses of the given record type, keyed by these addresses.
+func (b *dnsmasqBackend) findHosts(api *opnsense.OpnSenseApi, hostname, domain, recordType string) (map[string]*opnsense.DnsmasqHost, error) {
+	hosts, err := opnsense.SearchDnsmasqHosts(api, strings.TrimSpace(hostname+" "+domain))
+	if err != nil {
+		return nil, err
+	}
+	found := map[string]*opnsense.DnsmasqHost{}
+	for _, h := range hosts {
+		if h.HostName != hostname || h.Domain != domain {
+			continue
+		}
+		for _, ip := range h.Addresses() {
+			if opnsense.AddressType(ip) == recordType {
+				found[ip] = h
+			}
+		}
+	}
+	return found, nil
+}
+
+// currentHosts returns the host overrides referenced by the uuid label of ep, keyed by their addresses of the record type of ep.
+// Overrides that do not belong to the given name or hold no such address are rejected.
+func (b *dnsmasqBackend) currentHosts(api *opnsense.OpnSenseApi, ep *endpoint.Endpoint, hostname, domain string) (map[string]*opnsense.DnsmasqHost, error) {
+	hosts, err := opnsense.SearchDnsmasqHosts(api, "")
+	if err != nil {
+		return nil, err
+	}
+	byUuid := map[string]*opnsense.DnsmasqHost{}
+	for _, h := range hosts {
+		byUuid[h.Uuid] = h
+	}
+	found := map[string]*opnsense.DnsmasqHost{}
+	for _, uuid := range strings.Split(ep.Labels["uuid"], ",") {
+		host, ok := byUuid[uuid]
+		if !ok {
+			return nil, fmt.Errorf("dnsmasq host override %s not found", uuid)
+		}
+		if host.HostName != hostname || host.Domain != domain {
+			return nil, fmt.Errorf("dnsmasq host override %s is %s, expected %s", uuid, opnsense.JoinDNSName(host.HostName, host.Domain), ep.DNSName)
+		}
+		matched := false
+		for _, ip := range host.Addresses() {
+			if opnsense.AddressType(ip) == ep.RecordType {
+				found[ip] = host
+				matched = true
+			}
+		}
+		if !matched {
+			return nil, fmt.Errorf("dnsmasq host override %s of %s holds no %s address: %s", uuid, ep.DNSName, ep.RecordType, host.Ip)
+		}
+	}
+	return found, nil
+}
+
+// holdsOnly reports whether all addresses of host are of the given record type.
+func holdsOnly(host *opnsense.DnsmasqHost, recordType string) bool {
+	for _, ip := range host.Addresses() {
+		if opnsense.AddressType(ip) != recordType {
+			return false
+		}
+	}
+	return true
+}
+
+// dnsmasqEdit collects changes to the addresses of existing host overrides, so an override holding
+// several addresses is written once.
+type dnsmasqEdit struct {
+	hosts     map[string]*opnsense.DnsmasqHost
+	addresses map[string][]string
+}
+
+// newDnsmasqEdit starts an edit of the host overrides in existing, as returned by findHosts or currentHosts.
+func newDnsmasqEdit(existing map[string]*opnsense.DnsmasqHost) *dnsmasqEdit {
+	e := &dnsmasqEdit{hosts: map[string]*opnsense.DnsmasqHost{}, addresses: map[string][]string{}}
+	for _, host := range existing {
+		if _, ok := e.hosts[host.Uuid]; !ok {
+			e.hosts[host.Uuid] = host
+			e.addresses[host.Uuid] = host.Addresses()
+		}
+	}
+	return e
+}
+
+// replace swaps the address old of host for ip.
+func (e *dnsmasqEdit) replace(host *opnsense.DnsmasqHost, old, ip string) {
+	addresses := e.addresses[host.Uuid]
+	if i := slices.Index(addresses, old); i >= 0 {
+		addresses[i] = ip
+	}
+}
+
+// remove drops the address ip from host.
+func (e *dnsmasqEdit) remove(host *opnsense.DnsmasqHost, ip string) {
+	e.addresses[host.Uuid] = slices.DeleteFunc(e.addresses[host.Uuid], func(a string) bool { return a == ip })
+}
+
+// write saves the changed host overrides and deletes the ones left without addresses. Overrides only holding
+// addresses of recordType get description, unless it is empty.
+func (e *dnsmasqEdit) write(api *opnsense.OpnSenseApi, recordType, description string) error {
+	for _, uuid := range slices.Sorted(maps.Keys(e.hosts)) {
+		current := e.hosts[uuid]
+		addresses := e.addresses[uuid]
+		if len(addresses) == 0 {
+			if err := current.Delete(api); err != nil {
+				return err
+			}
+			continue
+		}
+		host := *current
+		host.Ip = strings.Join(addresses, ",")
+		if description != "" && holdsOnly(&host, recordType) {
+			host.Description = description
+		}
+		if host.Ip == current.Ip && host.Description == current.Description {
+			continue
+		}
+		if err := host.Update(api); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// isRegistryRecord reports whether ep is a TXT record of the external-dns TXT registry, and logs that it is skipped.
+// Dnsmasq can not store it, but needs none either: the owner is kept in the description of the host overrides
+// and listed as owner label, which the registry keeps for records without a TXT record. This requires the
+// --txt-owner-id of external-dns to match EXTERNAL_DNS_OWNER.
+func isRegistryRecord(ep *endpoint.Endpoint) bool {
+	if ep.RecordType != endpoint.RecordTypeTXT || !slices.ContainsFunc(ep.Targets, func(target string) bool {
+		return strings.Contains(target, "heritage=external-dns")
+	}) {
+		return false
+	}
+	log.Printf("Skipping TXT registry record %s, the dnsmasq backend keeps the owner in the descriptions\n", ep.DNSName)
+	return true
+}
+
+// checkDnsmasqRecordType refuses record types Dnsmasq host overrides can not hold.
+func checkDnsmasqRecordType(ep *endpoint.Endpoint) error {
+	if ep.RecordType != endpoint.RecordTypeA && ep.RecordType != endpoint.RecordTypeAAAA {
+		return fmt.Errorf("record type %s of %s is not supported by the dnsmasq backend", ep.RecordType, ep.DNSName)
+	}
+	return nil
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+
+	opnsense "external-dns-opnsense/opnsense"
+
+	"sigs.k8s.io/external-dns/endpoint"
+	"sigs.k8s.io/external-dns/plan"
+	"sigs.k8s.io/external-dns/registry"
+)
+
+func TestDnsmasqMixedHost(t *testing.T) {
+	p, srv := newWebhookProvider(t, opnsense.BackendDnsmasq)
+	srv.AddDnsmasqHost(opnsense.DnsmasqHost{
+		HostName:    "www",
+		Domain:      "example.com",
+		Ip:          "192.0.2.1, 2001:db8::1",
+		Description: api.Description("", endpoint.RecordTypeA),
+	})
+	steps := []struct {
+		name    string
+		changes func(records map[string]*endpoint.Endpoint) plan.Changes
+		ips     []string
+	}{
+		{"update A", func(records map[string]*endpoint.Endpoint) plan.Changes {
+			updated := records["www.example.com A"].DeepCopy()
+			updated.Targets = endpoint.Targets{"192.0.2.2"}
+			return plan.Changes{UpdateOld: []*endpoint.Endpoint{records["www.example.com A"]}, UpdateNew: []*endpoint.Endpoint{updated}}
+		}, []string{"192.0.2.2,2001:db8::1"}},
+		{"add A", func(records map[string]*endpoint.Endpoint) plan.Changes {
+			updated := records["www.example.com A"].DeepCopy()
+			updated.Targets = endpoint.Targets{"192.0.2.2", "192.0.2.3"}
+			return plan.Changes{UpdateOld: []*endpoint.Endpoint{records["www.example.com A"]}, UpdateNew: []*endpoint.Endpoint{updated}}
+		}, []string{"192.0.2.2,2001:db8::1", "192.0.2.3"}},
+		{"delete A", func(records map[string]*endpoint.Endpoint) plan.Changes {
+			return plan.Changes{Delete: []*endpoint.Endpoint{records["www.example.com A"]}}
+		}, []string{"2001:db8::1"}},
+		{"delete AAAA", func(records map[string]*endpoint.Endpoint) plan.Changes {
+			return plan.Changes{Delete: []*endpoint.Endpoint{records["www.example.com AAAA"]}}
+		}, []string{}},
+	}
+	for _, step := range steps {
+		records := recordsByName(t, p)
+		if errs := ApplyChanges(NewBackend(api), step.changes(records)); len(errs) != 0 {
+			t.Fatalf("%s: ApplyChanges returned %v", step.name, errs)
+		}
+		ips := []string{}
+		for _, host := range srv.DnsmasqHosts() {
+			ips = append(ips, host.Ip)
+		}
+		if !slices.Equal(ips, step.ips) {
+			t.Fatalf("%s: hosts hold %v, want %v", step.name, ips, step.ips)
+		}
+	}
+}
+
+func TestDnsmasqIgnoresTTL(t *testing.T) {
+	p, _ := newWebhookProvider(t, opnsense.BackendDnsmasq)
+	desired, err := AdjustEndpoints(api, []*endpoint.Endpoint{
+		endpoint.NewEndpointWithTTL("www.example.com", endpoint.RecordTypeA, 300, "192.0.2.1"),
+	})
+	if err != nil || len(desired) != 1 {
+		t.Fatalf("AdjustEndpoints returned %v, %v", desired, err)
+	}
+	if errs := ApplyChanges(NewBackend(api), plan.Changes{Create: desired}); len(errs) != 0 {
+		t.Fatalf("ApplyChanges returned %v", errs)
+	}
+
+	// Dnsmasq stores no TTL, so the desired record must match the listed one
+	listed := recordsByName(t, p)["www.example.com A"]
+	if listed == nil || listed.RecordTTL != desired[0].RecordTTL {
+		t.Errorf("listed %v, desired %v: the TTL would differ on every sync", listed, desired[0])
+	}
+}
+
+func TestDnsmasqTXTRegistry(t *testing.T) {
+	p, srv := newWebhookProvider(t, opnsense.BackendDnsmasq)
+	ctx := context.Background()
+	// external-dns wraps the webhook in its default TXT registry
+	reg, err := registry.NewTXTRegistry(p, "", "", api.OwnerID, 0, "", []string{endpoint.RecordTypeA, endpoint.RecordTypeAAAA}, nil, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	www := endpoint.NewEndpoint("www.example.com", endpoint.RecordTypeA, "192.0.2.1")
+	if err := reg.ApplyChanges(ctx, &plan.Changes{Create: []*endpoint.Endpoint{www}}); err != nil {
+		t.Fatalf("ApplyChanges create: %v", err)
+	}
+	if hosts := srv.DnsmasqHosts(); len(hosts) != 1 {
+		t.Fatalf("%d hosts stored, want 1", len(hosts))
+	}
+
+	// Without TXT records, the registry takes the owner from the descriptions
+	records, err := reg.Records(ctx)
+	if err != nil || len(records) != 1 {
+		t.Fatalf("Records returned %v, %v", records, err)
+	}
+	if owner := records[0].Labels[endpoint.OwnerLabelKey]; owner != api.OwnerID {
+		t.Errorf("www.example.com is owned by %q, want %q", owner, api.OwnerID)
+	}
+	if err := reg.ApplyChanges(ctx, &plan.Changes{Delete: records}); err != nil {
+		t.Fatalf("ApplyChanges delete: %v", err)
+	}
+	if hosts := srv.DnsmasqHosts(); len(hosts) != 0 {
+		t.Errorf("hosts %v remain after the deletion", hosts)
+	}
+}
+
+func TestDnsmasqCreateNextToUnowned(t *testing.T) {
+	srv := newTestServer(t, opnsense.BackendDnsmasq)
+	api.ConflictPolicy = opnsense.ConflictRefuse
+	srv.AddDnsmasqHost(opnsense.DnsmasqHost{HostName: "www", Domain: "example.com", Ip: "192.0.2.1"})
+
+	// A second address would turn the name of the admin into a round-robin
+	www := endpoint.NewEndpoint("www.example.com", endpoint.RecordTypeA, "192.0.2.2")
+	errs := ApplyChanges(NewBackend(api), plan.Changes{Create: []*endpoint.Endpoint{www}})
+	if len(errs) != 1 || !errors.Is(errs[0], opnsense.ErrOwnershipConflict) {
+		t.Fatalf("ApplyChanges returned %v, want %v", errs, opnsense.ErrOwnershipConflict)
+	}
+	if hosts := srv.DnsmasqHosts(); len(hosts) != 1 {
+		t.Errorf("hosts %v stored, want only the unowned one", hosts)
+	}
+}
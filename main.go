@@ -1,25 +1,112 @@
 package main
 
 import (
-	opnsense "external-dns-opnsense/opnsense"
+	"fmt"
+	"io/fs"
 	"log"
+	"net"
 	"net/http"
+	"os"
+	"time"
+
+	opnsense "external-dns-opnsense/opnsense"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 // Global variable to hold the OpnSense configuration
 var api *opnsense.OpnSenseApi
 
-func main() {
-	// Register HTTP handlers for the webhook server
-	http.HandleFunc("/", negotiateHandler)                      // Handles negotiation requests
-	http.HandleFunc("/records", recordsHandler)                 // Handles requests to retrieve or edit DNS records
-	http.HandleFunc("/adjustendpoints", adjustendpointsHandler) // Handles requests to adjust DNS endpoints
-	http.HandleFunc("/healthz", healthzHandler)                 // Health check endpoint
+// webhookHandler returns the HTTP handlers of the webhook API.
+func webhookHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/", instrument("negotiate", negotiateHandler))                            // Handles negotiation requests
+	mux.Handle("/records", instrument("records", recordsHandler))                         // Handles requests to retrieve or edit DNS records
+	mux.Handle("/adjustendpoints", instrument("adjustendpoints", adjustendpointsHandler)) // Handles requests to adjust DNS endpoints
+	mux.HandleFunc("/healthz", healthzHandler)                                            // Health check endpoint, kept for existing probes
+	return mux
+}
+
+// healthHandler returns the HTTP handlers of the health and metrics listener.
+func healthHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", healthzHandler) // Liveness probe
+	mux.HandleFunc("/readyz", readyzHandler)   // Readiness probe, checks the firewall
+	mux.Handle("/metrics", promhttp.Handler()) // Prometheus metrics
+	return mux
+}
 
+// listenAddress returns the address in the environment variable name, or def if it is unset.
+// An empty value disables the listener.
+func listenAddress(name, def string) string {
+	if address, ok := os.LookupEnv(name); ok {
+		return address
+	}
+	return def
+}
+
+// listenUnix listens on the Unix domain socket path, replacing a socket left over by a previous run.
+func listenUnix(path string) (net.Listener, error) {
+	if info, err := os.Lstat(path); err == nil && info.Mode().Type() == fs.ModeSocket {
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+	return net.Listen("unix", path)
+}
+
+func main() {
 	// Load the OpnSense configuration from environment variables
 	api = opnsense.LoadConfigFromEnv()
+	if ttl := os.Getenv("READINESS_CACHE_TTL"); ttl != "" {
+		if parsed, err := time.ParseDuration(ttl); err == nil && parsed >= 0 {
+			ready = newReadiness(parsed)
+		} else {
+			log.Printf("Invalid READINESS_CACHE_TTL value '%s', using default of %s", ttl, ready.ttl)
+		}
+	}
+
+	// The webhook API stays on the loopback by default, external-dns runs as sidecar in the same pod
+	webhookAddress := listenAddress("WEBHOOK_LISTEN_ADDRESS", "localhost:8888")
+	webhookSocket := os.Getenv("WEBHOOK_SOCKET")
+	// Probes and metrics follow the convention of external-dns webhooks
+	healthAddress := listenAddress("HEALTH_LISTEN_ADDRESS", ":8080")
+
+	if webhookAddress == "" && webhookSocket == "" {
+		log.Fatalf("Neither WEBHOOK_LISTEN_ADDRESS nor WEBHOOK_SOCKET is set, the webhook would not be reachable")
+	}
+
+	errs := make(chan error)
+	serve := func(name string, listener net.Listener, handler http.Handler) {
+		log.Printf("%s listening on %s", name, listener.Addr())
+		go func() {
+			errs <- fmt.Errorf("%s on %s: %w", name, listener.Addr(), http.Serve(listener, handler))
+		}()
+	}
+	listen := func(name, network, address string, handler http.Handler) {
+		var listener net.Listener
+		var err error
+		if network == "unix" {
+			listener, err = listenUnix(address)
+		} else {
+			listener, err = net.Listen(network, address)
+		}
+		if err != nil {
+			log.Fatalf("%s failed to listen on %s: %v", name, address, err)
+		}
+		serve(name, listener, handler)
+	}
+
+	if webhookAddress != "" {
+		listen("Webhook server", "tcp", webhookAddress, webhookHandler())
+	}
+	if webhookSocket != "" {
+		listen("Webhook server", "unix", webhookSocket, webhookHandler())
+	}
+	if healthAddress != "" {
+		listen("Health and metrics server", "tcp", healthAddress, healthHandler())
+	}
 
-	// Start the webhook server on port 8888
-	log.Println("Webhook server listening on :8888")
-	log.Fatal(http.ListenAndServe("localhost:8888", nil)) // Log fatal errors if the server fails to start
+	// Log fatal errors if a server stops
+	log.Fatal(<-errs)
 }
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"net/http"
+
+	opnsense "external-dns-opnsense/opnsense"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"sigs.k8s.io/external-dns/endpoint"
+)
+
+var (
+	webhookRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "external_dns_opnsense",
+		Subsystem: "webhook",
+		Name:      "requests_total",
+		Help:      "Webhook requests by handler, method and status code.",
+	}, []string{"handler", "method", "code"})
+	webhookRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "external_dns_opnsense",
+		Subsystem: "webhook",
+		Name:      "request_duration_seconds",
+		Help:      "Time to answer webhook requests by handler and method.",
+		Buckets:   []float64{0.01, 0.05, 0.1, 0.5, 1, 2.5, 5, 10, 30, 60},
+	}, []string{"handler", "method"})
+	recordChanges = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "external_dns_opnsense",
+		Subsystem: "records",
+		Name:      "changes_total",
+		Help:      "Records created, updated or deleted by record type and result, \"success\" or \"error\".",
+	}, []string{"operation", "type", "result"})
+	managedRecords = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "external_dns_opnsense",
+		Subsystem: "records",
+		Name:      "managed",
+		Help:      "Records owned by this instance by domain and record type, as of the last successful listing.",
+	}, []string{"domain", "type"})
+)
+
+func init() {
+	prometheus.MustRegister(webhookRequests, webhookRequestDuration, recordChanges, managedRecords)
+}
+
+// instrument counts and times the requests to the webhook handler h.
+func instrument(handler string, h http.HandlerFunc) http.Handler {
+	labels := prometheus.Labels{"handler": handler}
+	return promhttp.InstrumentHandlerDuration(webhookRequestDuration.MustCurryWith(labels),
+		promhttp.InstrumentHandlerCounter(webhookRequests.MustCurryWith(labels), h))
+}
+
+// observeChange counts a record change of the given operation, e.g. "create", and its result.
+func observeChange(operation string, ep *endpoint.Endpoint, err error) {
+	result := "success"
+	if err != nil {
+		result = "error"
+	}
+	recordChanges.WithLabelValues(operation, ep.RecordType, result).Inc()
+}
+
+// observeManaged sets the managed record gauges to the owned endpoints, replacing the last listing.
+func observeManaged(api *opnsense.OpnSenseApi, endpoints []*endpoint.Endpoint) {
+	managedRecords.Reset()
+	for _, ep := range endpoints {
+		if ep.Labels[readOnlyLabel] == "true" {
+			continue
+		}
+		domain := api.FindZone(ep.DNSName)
+		if domain == "" {
+			if _, d, err := api.SplitDNSName(ep.DNSName); err == nil {
+				domain = d
+			}
+		}
+		managedRecords.WithLabelValues(domain, ep.RecordType).Inc()
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	opnsense "external-dns-opnsense/opnsense"
+
+	"sigs.k8s.io/external-dns/endpoint"
+	"sigs.k8s.io/external-dns/plan"
+)
+
+func TestMetrics(t *testing.T) {
+	p, _ := newWebhookProvider(t, opnsense.BackendUnbound)
+	changes := &plan.Changes{Create: []*endpoint.Endpoint{endpoint.NewEndpoint("www.example.com", endpoint.RecordTypeA, "192.0.2.1")}}
+	if err := p.ApplyChanges(context.Background(), changes); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.Records(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	rec := httptest.NewRecorder()
+	healthHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("GET /metrics returned %d", rec.Code)
+	}
+	body, _ := io.ReadAll(rec.Body)
+	for _, want := range []string{
+		`external_dns_opnsense_webhook_requests_total{code="204",handler="records",method="post"}`,
+		`external_dns_opnsense_webhook_request_duration_seconds_count{handler="records",method="get"}`,
+		`external_dns_opnsense_api_requests_total{endpoint="/unbound/settings/add_host_override",method="POST",status="200"}`,
+		`external_dns_opnsense_api_request_duration_seconds_count{endpoint="/unbound/settings/search_host_override",method="POST"}`,
+		`external_dns_opnsense_records_changes_total{operation="create",result="success",type="A"}`,
+		`external_dns_opnsense_records_managed{domain="example.com",type="A"} 1`,
+		`external_dns_opnsense_reconfigure_duration_seconds_count{service="unbound"}`,
+		`external_dns_opnsense_reconfigure_skipped_total`,
+	} {
+		if !strings.Contains(string(body), want) {
+			t.Errorf("metrics miss %s", want)
+		}
+	}
+}
@@ -4,10 +4,12 @@ import (
 	"encoding/json"
 	"log"
 	"net/http"
+
+	"sigs.k8s.io/external-dns/endpoint"
 )
 
 // negotiateHandler handles HTTP requests to negotiate and retrieve the current configuration state.
-// Only GET requests are allowed. It responds with a JSON-encoded configuration state.
+// Only GET requests are allowed. It responds with the JSON-encoded domain filter.
 func negotiateHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
 		http.Error(w, "Only GET allowed", http.StatusMethodNotAllowed)
@@ -16,19 +18,11 @@ func negotiateHandler(w http.ResponseWriter, r *http.Request) {
 
 	log.Printf("Negotiating configuration state")
 
-	config := struct {
-		DomainFilter struct {
-			Domains []string `json:"domains"`
-		} `json:"DomainFilter"`
-	}{
-		DomainFilter: struct {
-			Domains []string `json:"domains"`
-		}{
-			Domains: api.DNSDomainFilter,
-		},
-	}
+	// external-dns decodes the answer directly into its endpoint.DomainFilter. Any other shape decodes
+	// into an empty filter, which matches every domain and leaves DOMAIN_FILTER without effect.
+	domainFilter := endpoint.NewDomainFilter(api.DNSDomainFilter)
 
 	// Set the response content type to JSON and encode the state into the response.
 	w.Header().Set("Content-Type", "application/external.dns.webhook+json;version=1")
-	json.NewEncoder(w).Encode(config)
+	json.NewEncoder(w).Encode(domainFilter)
 }
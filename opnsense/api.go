@@ -1,16 +1,18 @@
 package opnsense
 
 import (
+	"bytes"
 	"context"
-	"crypto/tls"
 	"encoding/base64"
 	"encoding/json"
+	"fmt"
 	"io"
 	"log"
 	"net/http"
 	"net/url"
 	"os"
 	"path"
+	"strconv"
 	"strings"
 	"time"
 
@@ -29,6 +31,15 @@ func LoadConfigFromEnv() *OpnSenseApi {
 	domainFilter := strings.Split(os.Getenv("DOMAIN_FILTER"), ",")
 	ownerId := os.Getenv("EXTERNAL_DNS_OWNER")
 	tlsVerifyStr := os.Getenv("OPNSENSE_API_TLS_VERIFY")
+	zones := []string{}
+	if zonesStr := os.Getenv("DNS_ZONES"); zonesStr != "" {
+		zones = strings.Split(zonesStr, ",")
+	}
+	zoneFallback := os.Getenv("ZONE_FALLBACK")
+	conflictPolicy := os.Getenv("CONFLICT_POLICY")
+	includeUnownedStr := os.Getenv("INCLUDE_UNOWNED_RECORDS")
+	http2Str := os.Getenv("OPNSENSE_API_HTTP2")
+	backend := os.Getenv("DNS_BACKEND")
 
 	missingConfig := false
 	missingConfigParams := []string{}
@@ -65,8 +76,63 @@ func LoadConfigFromEnv() *OpnSenseApi {
 		tlsVerifyStr = "true"
 	}
 
+	switch zoneFallback {
+	case "":
+		zoneFallback = ZoneFallbackFirstLabel
+	case ZoneFallbackFirstLabel, ZoneFallbackReject:
+	default:
+		log.Printf("Invalid ZONE_FALLBACK value '%s', using default of %s", zoneFallback, ZoneFallbackFirstLabel)
+		zoneFallback = ZoneFallbackFirstLabel
+	}
+
+	switch conflictPolicy {
+	case "":
+		conflictPolicy = ConflictRefuse
+	case ConflictRefuse, ConflictAdoptUnowned, ConflictAdopt:
+	default:
+		log.Printf("Invalid CONFLICT_POLICY value '%s', using default of %s", conflictPolicy, ConflictRefuse)
+		conflictPolicy = ConflictRefuse
+	}
+
+	switch backend {
+	case "":
+		backend = BackendUnbound
+	case BackendUnbound, BackendDnsmasq, BackendBind:
+	default:
+		log.Fatalf("Unsupported DNS_BACKEND value '%s'", backend)
+	}
+
+	clientConfig := DefaultClientConfig()
+	clientConfig.Timeout = timeout
+	clientConfig.TLSVerify = strings.ToLower(tlsVerifyStr) == "true"
+	clientConfig.MaxConnsPerHost = envInt("OPNSENSE_API_MAX_CONNS", clientConfig.MaxConnsPerHost)
+	clientConfig.MaxIdleConnsPerHost = envInt("OPNSENSE_API_MAX_IDLE_CONNS", clientConfig.MaxIdleConnsPerHost)
+	clientConfig.IdleConnTimeout = envDuration("OPNSENSE_API_IDLE_CONN_TIMEOUT", clientConfig.IdleConnTimeout)
+	clientConfig.DisableHTTP2 = strings.ToLower(http2Str) == "false"
+
+	retry := DefaultRetryPolicy()
+	retry.MaxRetries = envInt("OPNSENSE_API_RETRIES", retry.MaxRetries)
+	retry.BaseDelay = envDuration("OPNSENSE_API_RETRY_BASE_DELAY", retry.BaseDelay)
+	retry.MaxDelay = envDuration("OPNSENSE_API_RETRY_MAX_DELAY", retry.MaxDelay)
+	retry.Budget = envInt("OPNSENSE_API_RETRY_BUDGET", retry.Budget)
+
+	rate := envFloat("OPNSENSE_API_RATE_LIMIT", 10)
+	burst := envInt("OPNSENSE_API_RATE_BURST", 20)
+	maxInFlight := envInt("OPNSENSE_API_MAX_IN_FLIGHT", 4)
+
+	reconfigureRetries := envInt("OPNSENSE_RECONFIGURE_RETRIES", 2)
+	reconfigureRetryDelay := envDuration("OPNSENSE_RECONFIGURE_RETRY_DELAY", 2*time.Second)
+	reconfigureWindow := envDuration("OPNSENSE_RECONFIGURE_WINDOW", 0)
+	reconfigureMaxDelay := envDuration("OPNSENSE_RECONFIGURE_MAX_DELAY", 10*time.Second)
+	reconfigureAsync := strings.ToLower(os.Getenv("OPNSENSE_RECONFIGURE_ASYNC")) == "true"
+
 	log.Printf("Using OpnSense API Host: %s", apiHost)
 	log.Printf("With Timeout: %s", timeout.String())
+	log.Printf("Managing DNS records of %s", backend)
+	if reconfigureWindow > 0 {
+		log.Printf("Coalescing reconfigures within %s, at most %s after the first commit, async: %t", reconfigureWindow, reconfigureMaxDelay, reconfigureAsync)
+	}
+	log.Printf("Limiting API requests to %g/s with bursts of %d and %d in flight, 0 means no limit", rate, burst, maxInFlight)
 
 	api := OpnSenseApi{
 		Ctx:             context.Background(),
@@ -75,12 +141,69 @@ func LoadConfigFromEnv() *OpnSenseApi {
 		APIHost:         apiHost,
 		ApiTimeout:      timeout,
 		DNSDomainFilter: domainFilter,
+		Zones:           zones,
+		ZoneFallback:    zoneFallback,
 		OwnerID:         ownerId,
-		TLSVerify:       strings.ToLower(tlsVerifyStr) == "true",
+		ConflictPolicy:  conflictPolicy,
+		IncludeUnowned:  strings.ToLower(includeUnownedStr) == "true",
+		Backend:         backend,
+		TLSVerify:       clientConfig.TLSVerify,
+		Client:          NewHTTPClient(clientConfig),
+		Retry:           &retry,
+		Limiter:         NewLimiter(rate, burst, maxInFlight),
+
+		ReconfigureRetries:    reconfigureRetries,
+		ReconfigureRetryDelay: reconfigureRetryDelay,
+	}
+	if reconfigureWindow > 0 {
+		// The scheduler reconfigures through its own copy, outside of the batches of the commits
+		api.Scheduler = NewReconfigureScheduler(api.WithContext(context.Background()), backend, reconfigureWindow, reconfigureMaxDelay, reconfigureAsync)
 	}
 	return &api
 }
 
+// envInt returns the non-negative integer in the environment variable name, or def if it is unset or invalid.
+func envInt(name string, def int) int {
+	str := os.Getenv(name)
+	if str == "" {
+		return def
+	}
+	value, err := strconv.Atoi(str)
+	if err != nil || value < 0 {
+		log.Printf("Invalid %s value '%s', using default of %d", name, str, def)
+		return def
+	}
+	return value
+}
+
+// envFloat returns the non-negative number in the environment variable name, or def if it is unset or invalid.
+func envFloat(name string, def float64) float64 {
+	str := os.Getenv(name)
+	if str == "" {
+		return def
+	}
+	value, err := strconv.ParseFloat(str, 64)
+	if err != nil || value < 0 {
+		log.Printf("Invalid %s value '%s', using default of %g", name, str, def)
+		return def
+	}
+	return value
+}
+
+// envDuration returns the duration in the environment variable name, or def if it is unset or invalid.
+func envDuration(name string, def time.Duration) time.Duration {
+	str := os.Getenv(name)
+	if str == "" {
+		return def
+	}
+	value, err := time.ParseDuration(str)
+	if err != nil || value < 0 {
+		log.Printf("Invalid %s value '%s', using default of %s", name, str, def)
+		return def
+	}
+	return value
+}
+
 // ApiRequest performs an HTTP request to the OpnSense API with the specified method, endpoint, and body.
 // It handles context management and adds the required authentication headers.
 func (api *OpnSenseApi) ApiRequest(method, endpoint string, body io.Reader) (*http.Response, error) {
@@ -88,12 +211,57 @@ func (api *OpnSenseApi) ApiRequest(method, endpoint string, body io.Reader) (*ht
 	if ctx == nil {
 		ctx = context.Background()
 	}
+	// The timeout must outlive this function, the caller still reads the response body
+	cancel := context.CancelFunc(func() {})
 	if _, ok := ctx.Deadline(); !ok {
-		var cancel context.CancelFunc
 		ctx, cancel = context.WithTimeout(ctx, api.ApiTimeout)
-		defer cancel()
 	}
+	resp, err := api.doRequestWithRetry(ctx, method, endpoint, body)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	resp.Body = drainingBody{ReadCloser: resp.Body, cancel: cancel}
+	return resp, nil
+}
 
+// doRequestWithRetry sends the request and retries it following api.Retry, see RetryPolicy.
+func (api *OpnSenseApi) doRequestWithRetry(ctx context.Context, method, endpoint string, body io.Reader) (*http.Response, error) {
+	if api.Retry == nil || api.Retry.MaxRetries <= 0 {
+		return api.doRequest(ctx, method, endpoint, body)
+	}
+	// Keep the body to send it again
+	var payload []byte
+	if body != nil {
+		var err error
+		if payload, err = io.ReadAll(body); err != nil {
+			return nil, err
+		}
+	}
+	read := isRead(method, endpoint)
+	for retry := 0; ; retry++ {
+		if payload != nil {
+			body = bytes.NewReader(payload)
+		}
+		resp, err := api.doRequest(ctx, method, endpoint, body)
+		if retry == api.Retry.MaxRetries || ctx.Err() != nil || !retryable(read, resp, err) || !api.takeRetry(method, endpoint) {
+			return resp, err
+		}
+		cause := ""
+		if err != nil {
+			cause = err.Error()
+		} else {
+			cause = fmt.Sprintf("status code %d", resp.StatusCode)
+			resp.Body.Close()
+		}
+		if err := api.waitRetry(ctx, method, endpoint, retry+1, cause); err != nil {
+			return nil, fmt.Errorf("%s %s: %w", method, endpoint, err)
+		}
+	}
+}
+
+// doRequest sends a single authenticated request to the OpnSense API.
+func (api *OpnSenseApi) doRequest(ctx context.Context, method, endpoint string, body io.Reader) (*http.Response, error) {
 	u, err := url.Parse(api.APIHost)
 	if err != nil {
 		return nil, err
@@ -113,28 +281,30 @@ func (api *OpnSenseApi) ApiRequest(method, endpoint string, body io.Reader) (*ht
 		req.Header.Set("Content-Type", "application/json")
 	}
 
-	clientTransport := &http.Transport{
-		TLSClientConfig: &tls.Config{
-			InsecureSkipVerify: !api.TLSVerify,
-		},
-	}
-
-	client := &http.Client{
-		Transport: clientTransport,
-		Timeout:   api.ApiTimeout, // Match the client timeout to the context timeout
+	release := func() {}
+	if api.Limiter != nil {
+		if release, err = api.Limiter.Wait(ctx); err != nil {
+			log.Printf("Request to %s failed waiting for the rate limiter: %v", u.String(), err)
+			return nil, err
+		}
 	}
 
 	// log.Printf("Making %s request to %s", method, u.String())
-	resp, err := client.Do(req)
+	start := time.Now()
+	resp, err := api.client().Do(req)
 	// log.Printf("Received response with status code: %d and length %d", resp.StatusCode, resp.ContentLength)
 
 	if err != nil {
+		observeRequest(endpoint, method, 0, time.Since(start))
+		release()
 		if ctx.Err() != nil {
 			log.Printf("Request to %s failed due to context error: %v", u.String(), ctx.Err())
 		}
 		return nil, err
 	}
 
+	observeRequest(endpoint, method, resp.StatusCode, time.Since(start))
+	resp.Body = releasingBody{ReadCloser: resp.Body, release: release}
 	return resp, nil
 }
 
@@ -147,32 +317,40 @@ func (api *OpnSenseApi) WithContext(ctx context.Context) *OpnSenseApi {
 	return &copy
 }
 
-func (api *OpnSenseApi) ApplyChanges() error {
-	var applyResponse struct {
-		Status string `json:"status"`
+// saveRequest posts reqBody to an OpnSense add or set endpoint and checks the response.
+// A non-200 status or a result other than "saved" is reported as an APIError of failure, carrying
+// the validation messages of the API. It returns the UUID from the response, which only add endpoints set.
+func (api *OpnSenseApi) saveRequest(endpoint string, reqBody interface{}, failure error) (string, error) {
+	jsonBody, err := json.Marshal(reqBody)
+	if err != nil {
+		return "", err
 	}
-	ctx, cancel := context.WithTimeout(context.Background(), api.ApiTimeout)
-	defer cancel()
-	resp, err := api.WithContext(ctx).ApiRequest(http.MethodPost, "/unbound/service/reconfigure", nil)
+
+	api.noteWrite()
+	resp, err := api.ApiRequest(http.MethodPost, endpoint, bytes.NewReader(jsonBody))
 	if err != nil {
-		return err
+		return "", err
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		return nil
+		log.Printf("Request to %s failed, status code: %d\n", endpoint, resp.StatusCode)
+		return "", newAPIError(resp, failure)
 	}
 
-	err = json.NewDecoder(resp.Body).Decode(&applyResponse)
+	// check if the response contains an error message
+	var apiResp struct {
+		Result      string                 `json:"result"`
+		Uuid        string                 `json:"uuid"`
+		Validations map[string]interface{} `json:"validations"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&apiResp)
 	if err != nil {
-		return err
+		return "", err
 	}
-	if applyResponse.Status != "ok" {
-		log.Printf("API returned error during apply changes: %s", applyResponse.Status)
-		// return with error
-		return ErrFailedToApply
+	if apiResp.Result != "saved" || len(apiResp.Validations) > 0 {
+		log.Printf("API returned error: %s %v", apiResp.Result, apiResp.Validations)
+		return "", newAPIError(resp, failure).withResult(apiResp.Result, apiResp.Validations)
 	}
-
-	log.Printf("ApplyChanges: Successfull\n")
-	return nil
+	return apiResp.Uuid, nil
 }
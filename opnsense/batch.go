@@ -0,0 +1,72 @@
+package opnsense
+
+import (
+	"context"
+	"log"
+	"sync/atomic"
+)
+
+// skippedReconfigures counts the reconfigures skipped by Commit since the start.
+var skippedReconfigures atomic.Int64
+
+// SkippedReconfigures returns the number of reconfigures skipped by Commit because nothing was written.
+func SkippedReconfigures() int64 {
+	return skippedReconfigures.Load()
+}
+
+// batch is the state shared by the requests of a batch, see WithBatch.
+type batch struct {
+	limitRetries bool
+	retries      atomic.Int64
+	writes       atomic.Int64
+}
+
+// WithBatch returns a shallow copy of OpnSenseApi starting a new batch of requests, like the
+// changes of one webhook request. Its requests, including those of its own copies, share a budget
+// of Retry.Budget retries, so a failing firewall is not hammered with retries, and count their
+// writes, so Commit can skip the reconfigure if nothing was written.
+func (api *OpnSenseApi) WithBatch() *OpnSenseApi {
+	copy := *api
+	copy.batch = &batch{}
+	if api.Retry != nil && api.Retry.Budget > 0 {
+		copy.batch.limitRetries = true
+		copy.batch.retries.Store(int64(api.Retry.Budget))
+	}
+	return &copy
+}
+
+// takeRetry uses one retry of the budget. It returns false if the budget is exhausted.
+func (b *batch) takeRetry() bool {
+	return !b.limitRetries || b.retries.Add(-1) >= 0
+}
+
+// noteWrite records that a write was sent in the batch. Writes are counted before they are sent,
+// as a failed write may still have changed the configuration.
+func (api *OpnSenseApi) noteWrite() {
+	if api.batch != nil {
+		api.batch.writes.Add(1)
+	}
+}
+
+// Commit reconfigures service to activate the writes of the batch. A batch without writes has
+// nothing to activate, so its reconfigure is skipped. Outside of a batch, service is always reconfigured.
+// With a ReconfigureScheduler for service, the reconfigure is left to the scheduler.
+//
+// The reconfigure gets a timeout of ApiTimeout of its own: the writes of a long batch may have used
+// up the deadline of the context of api, but they are saved already and must still be activated.
+func (api *OpnSenseApi) Commit(service string) error {
+	if api.batch != nil && api.batch.writes.Load() == 0 {
+		log.Printf("Commit: Nothing written, skipping reconfigure of %s, %d reconfigures skipped in total\n", service, skippedReconfigures.Add(1))
+		return nil
+	}
+	if api.Scheduler != nil && api.Scheduler.Service() == service {
+		return api.Scheduler.Request()
+	}
+	ctx := api.Ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), api.ApiTimeout)
+	defer cancel()
+	return api.WithContext(ctx).Reconfigure(service)
+}
@@ -0,0 +1,129 @@
+package opnsense
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+)
+
+// BindZone represents a primary zone of the BIND plugin (os-bind) in OpnSense.
+type BindZone struct {
+	Uuid       string `json:"uuid"`
+	Enabled    string `json:"enabled"`
+	DomainName string `json:"domainname"`
+}
+
+// BindRecord represents a resource record inside a primary zone of the BIND plugin.
+// Domain holds the UUID of the zone, Name is relative to the zone with "@" for its apex,
+// and Value is the record data in zone file syntax.
+type BindRecord struct {
+	Uuid    string `json:"uuid"`
+	Enabled string `json:"enabled"`
+	Domain  string `json:"domain"`
+	Name    string `json:"name"`
+	Type    string `json:"type"`
+	Value   string `json:"value"`
+}
+
+// searchBind posts a search request to a BIND plugin grid endpoint and decodes the rows into rows.
+func searchBind(api *OpnSenseApi, endpoint, searchPhrase string, rows interface{}) error {
+	body := map[string]interface{}{
+		"current":      1,
+		"rowCount":     -1,
+		"sort":         map[string]interface{}{},
+		"searchPhrase": searchPhrase,
+	}
+	jsonBody, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	resp, err := api.ApiRequest(http.MethodPost, endpoint, bytes.NewReader(jsonBody))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		log.Printf("Request to %s failed, status code: %d\n", endpoint, resp.StatusCode)
+		return newAPIError(resp, ErrFailedToRead)
+	}
+
+	searchResponse := struct {
+		Rows     interface{} `json:"rows"`
+		RowCount int         `json:"rowCount"`
+		Total    int         `json:"total"`
+		Current  int         `json:"current"`
+	}{
+		Rows: rows,
+	}
+	return json.NewDecoder(resp.Body).Decode(&searchResponse)
+}
+
+// SearchBindZones returns all primary zones of the BIND plugin.
+func SearchBindZones(api *OpnSenseApi) ([]*BindZone, error) {
+	zones := []*BindZone{}
+	if err := searchBind(api, "/bind/domain/searchPrimaryDomain/", "", &zones); err != nil {
+		return nil, err
+	}
+	return zones, nil
+}
+
+// SearchBindRecords returns the records of all primary zones matching searchPhrase.
+func SearchBindRecords(api *OpnSenseApi, searchPhrase string) ([]*BindRecord, error) {
+	records := []*BindRecord{}
+	if err := searchBind(api, "/bind/record/searchRecord/", searchPhrase, &records); err != nil {
+		return nil, err
+	}
+	return records, nil
+}
+
+// Add creates the record in its zone. On success the UUID of the new record is stored in record.Uuid.
+func (record *BindRecord) Add(api *OpnSenseApi) error {
+	reqBody := struct {
+		Record *BindRecord `json:"record"`
+	}{
+		Record: record,
+	}
+	log.Printf("Create: Creating BIND record [%s] %s => %s\n", record.Type, record.Name, record.Value)
+
+	uuid, err := api.saveRequest("/bind/record/addRecord/", reqBody, ErrFailedToCreate)
+	if err != nil {
+		return err
+	}
+	record.Uuid = uuid
+	return nil
+}
+
+// Update writes all fields of record to the record with its UUID.
+func (record *BindRecord) Update(api *OpnSenseApi) error {
+	endpoint := fmt.Sprintf("/bind/record/setRecord/%s", record.Uuid)
+	reqBody := struct {
+		Record *BindRecord `json:"record"`
+	}{
+		Record: record,
+	}
+	_, err := api.saveRequest(endpoint, reqBody, ErrFailedToUpdate)
+	return err
+}
+
+// Delete removes the record with the UUID of record.
+func (record *BindRecord) Delete(api *OpnSenseApi) error {
+	endpoint := fmt.Sprintf("/bind/record/delRecord/%s", record.Uuid)
+
+	api.noteWrite()
+	resp, err := api.ApiRequest(http.MethodPost, endpoint, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		log.Printf("Failed to delete BIND record with UUID %s, status code: %d\n", record.Uuid, resp.StatusCode)
+		return newAPIError(resp, ErrFailedToDelete)
+	}
+
+	log.Printf("Successfully deleted BIND record with UUID %s\n", record.Uuid)
+	return nil
+}
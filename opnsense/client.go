@@ -0,0 +1,111 @@
+package opnsense
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// ClientConfig configures the HTTP client used for all requests to the OpnSense API.
+type ClientConfig struct {
+	// Timeout limits a single request including reading the response.
+	Timeout time.Duration
+	// TLSVerify checks the certificate of the firewall.
+	TLSVerify bool
+	// MaxConnsPerHost limits the connections to the firewall, idle or not. Zero means no limit.
+	MaxConnsPerHost int
+	// MaxIdleConnsPerHost is the number of connections kept open between requests.
+	MaxIdleConnsPerHost int
+	// IdleConnTimeout closes idle connections after this time.
+	IdleConnTimeout time.Duration
+	// DisableHTTP2 sticks to HTTP/1.1 even if the firewall offers HTTP/2.
+	DisableHTTP2 bool
+}
+
+// DefaultClientConfig returns the client configuration used if none is set in the environment.
+func DefaultClientConfig() ClientConfig {
+	return ClientConfig{
+		Timeout:             30 * time.Second,
+		TLSVerify:           true,
+		MaxConnsPerHost:     8,
+		MaxIdleConnsPerHost: 8,
+		IdleConnTimeout:     90 * time.Second,
+	}
+}
+
+// NewHTTPClient returns a long-lived HTTP client reusing its connections to the firewall.
+// It is safe for concurrent use and should be shared by all requests.
+func NewHTTPClient(config ClientConfig) *http.Client {
+	transport := &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		TLSClientConfig: &tls.Config{
+			InsecureSkipVerify: !config.TLSVerify,
+		},
+		// A custom TLS config disables HTTP/2 unless it is asked for explicitly
+		ForceAttemptHTTP2:     !config.DisableHTTP2,
+		MaxConnsPerHost:       config.MaxConnsPerHost,
+		MaxIdleConns:          config.MaxIdleConnsPerHost,
+		MaxIdleConnsPerHost:   config.MaxIdleConnsPerHost,
+		IdleConnTimeout:       config.IdleConnTimeout,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+	if config.DisableHTTP2 {
+		// A non-nil empty map is how net/http is told not to upgrade to HTTP/2
+		transport.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+	}
+	return &http.Client{
+		Transport: transport,
+		Timeout:   config.Timeout,
+	}
+}
+
+// fallbackClients are the HTTP clients of APIs without a Client, one per TLS verification setting.
+// They are created on first use and shared, so their connections are reused like those of Client.
+var (
+	fallbackMu      sync.Mutex
+	fallbackClients = map[bool]*http.Client{}
+)
+
+// client returns the shared HTTP client of the API, or without one the shared fallback client.
+// The timeout of a request is set by its context, see ApiRequest.
+func (api *OpnSenseApi) client() *http.Client {
+	if api.Client != nil {
+		return api.Client
+	}
+	fallbackMu.Lock()
+	defer fallbackMu.Unlock()
+	client, ok := fallbackClients[api.TLSVerify]
+	if !ok {
+		config := DefaultClientConfig()
+		config.Timeout = 0
+		config.TLSVerify = api.TLSVerify
+		client = NewHTTPClient(config)
+		fallbackClients[api.TLSVerify] = client
+	}
+	return client
+}
+
+// drainingBody reads the rest of a response body before closing it. The decoders stop after the
+// JSON value, and a connection is only reused if its response body was read to the end.
+// Closing the body also releases the timeout of its request.
+type drainingBody struct {
+	io.ReadCloser
+	cancel func()
+}
+
+// maxDrain limits how much of an unread response body is read to keep its connection.
+const maxDrain = 64 << 10
+
+func (b drainingBody) Close() error {
+	defer b.cancel()
+	_, _ = io.Copy(io.Discard, io.LimitReader(b.ReadCloser, maxDrain))
+	return b.ReadCloser.Close()
+}
@@ -0,0 +1,64 @@
+package opnsense_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	opnsense "external-dns-opnsense/opnsense"
+	"external-dns-opnsense/opnsense/opnsensetest"
+)
+
+// BenchmarkApiRequest compares a shared HTTP client against a client built for every sync,
+// which costs a new connection, and with TLS a new handshake, per sync.
+func BenchmarkApiRequest(b *testing.B) {
+	servers := []struct {
+		name  string
+		start func() *opnsensetest.Server
+	}{
+		{"http", opnsensetest.NewServer},
+		{"https", opnsensetest.NewTLSServer},
+	}
+	for _, server := range servers {
+		srv := server.start()
+		uuids := make([]string, 0, 50)
+		for i := range cap(uuids) {
+			uuids = append(uuids, srv.AddHostOverride(opnsense.OpnSenseHostOverride{
+				Enabled:  "1",
+				HostName: fmt.Sprintf("host%d", i),
+				Domain:   "example.com",
+				Type:     "A",
+				Server:   fmt.Sprintf("192.0.2.%d", i),
+			}))
+		}
+
+		for _, shared := range []bool{false, true} {
+			name := server.name + "/per-sync"
+			if shared {
+				name = server.name + "/shared"
+			}
+			b.Run(name, func(b *testing.B) {
+				api := srv.Api().WithContext(context.Background())
+				config := opnsense.DefaultClientConfig()
+				config.TLSVerify = api.TLSVerify
+				for i := 0; b.Loop(); i++ {
+					if !shared {
+						api.Client = opnsense.NewHTTPClient(config)
+					}
+					// A sync searches the overrides and reads the ones it touches
+					if _, err := opnsense.SearchHostOverrides(api, ""); err != nil {
+						b.Fatal(err)
+					}
+					override := &opnsense.OpnSenseHostOverride{Uuid: uuids[i%len(uuids)]}
+					if err := override.GetByUUID(api); err != nil {
+						b.Fatal(err)
+					}
+					if !shared {
+						api.Client.CloseIdleConnections()
+					}
+				}
+			})
+		}
+		srv.Close()
+	}
+}
@@ -1,71 +1,88 @@
 package opnsense
 
 import (
-	"bytes"
-	"encoding/json"
 	"fmt"
 	"log"
-	"net/http"
 )
 
+// Create adds the host override to OpnSense, or updates the existing override with the same
+// hostname, domain, record type and target.
 func (override *OpnSenseHostOverride) Create(api *OpnSenseApi) error {
 	// Check, if override already exists
-	foundOverrides, err := SearchHostOverrides(api, fmt.Sprintf("%s %s", override.HostName, override.Domain))
+	foundOverrides, err := FindHostOverrides(api, override.HostName, override.Domain, override.Type, override.Target())
 	if err != nil {
 		return err
 	}
-	if len(foundOverrides) > 0 {
-		if len(foundOverrides) > 1 {
-			matchingOverrides := 0
-			for _, o := range foundOverrides {
-				if o.HostName == override.HostName && o.Domain == override.Domain {
-					matchingOverrides++
-				}
-			}
-			if matchingOverrides == 1 {
-				override.Uuid = foundOverrides[0].Uuid
-			} else {
-				return fmt.Errorf("Read: Multiple host overrides found for %s.%s", override.HostName, override.Domain)
-			}
-		}
-		log.Printf("Create: Host override %s.%s already exists, trying to update\n", override.HostName, override.Domain)
-		return override.Update(api)
-	} else {
-		reqBody := struct {
-			Host *OpnSenseHostOverride `json:"host"`
-		}{
-			Host: override,
-		}
-		jsonBody, err := json.Marshal(reqBody)
-		if err != nil {
+	if len(foundOverrides) > 1 {
+		return fmt.Errorf("Create: Multiple [%s] host overrides found for %s.%s", override.Type, override.HostName, override.Domain)
+	}
+	if len(foundOverrides) == 1 {
+		if err := api.CheckOwnership(JoinDNSName(override.HostName, override.Domain), foundOverrides[0].Description); err != nil {
 			return err
 		}
-		log.Printf("Create: Creating DNS entry [%s] %s => %s (TTL %s)\n", override.Type, override.HostName+"."+override.Domain, (override.Mx + override.Server + override.TxtData), override.TTL)
+		override.Uuid = foundOverrides[0].Uuid
+		log.Printf("Create: Host override [%s] %s.%s already exists, trying to update\n", override.Type, override.HostName, override.Domain)
+		return override.Update(api)
+	}
+	return override.Add(api)
+}
 
-		resp, err := api.ApiRequest(http.MethodPost, "/unbound/settings/add_host_override/", bytes.NewReader(jsonBody))
-		if err != nil {
-			return err
-		}
-		defer resp.Body.Close()
+// Add creates the host override on OpnSense without checking for existing overrides.
+// On success the UUID of the new override is stored in override.Uuid.
+func (override *OpnSenseHostOverride) Add(api *OpnSenseApi) error {
+	reqBody := struct {
+		Host *OpnSenseHostOverride `json:"host"`
+	}{
+		Host: override,
+	}
+	log.Printf("Create: Creating DNS entry [%s] %s => %s (TTL %s)\n", override.Type, override.HostName+"."+override.Domain, (override.Mx + override.Server + override.TxtData), override.TTL)
 
-		if resp.StatusCode != http.StatusOK {
-			log.Printf("Failed to create DNS entry, status code: %d", resp.StatusCode)
-			return ErrFailedToCreate
-		}
+	uuid, err := api.saveRequest("/unbound/settings/add_host_override/", reqBody, ErrFailedToCreate)
+	if err != nil {
+		return err
+	}
+	override.Uuid = uuid
+	return nil
+}
 
-		// check if the response contains an error message
-		var apiResp struct {
-			Result string `json:"result"`
-			Uuid   string `json:"uuid"`
+func (alias *OpnSenseHostAlias) Create(api *OpnSenseApi) error {
+	if alias.Host == "" {
+		return fmt.Errorf("Create: Host alias %s.%s has no parent host override", alias.HostName, alias.Domain)
+	}
+	// Check, if alias already exists
+	foundAliases, err := SearchHostAliases(api, fmt.Sprintf("%s %s", alias.HostName, alias.Domain))
+	if err != nil {
+		return err
+	}
+	matchingAliases := []*OpnSenseHostAlias{}
+	for _, a := range foundAliases {
+		if a.HostName == alias.HostName && a.Domain == alias.Domain {
+			matchingAliases = append(matchingAliases, a)
 		}
-		err = json.NewDecoder(resp.Body).Decode(&apiResp)
-		if err != nil {
+	}
+	if len(matchingAliases) > 1 {
+		return fmt.Errorf("Create: Multiple host aliases found for %s.%s", alias.HostName, alias.Domain)
+	}
+	if len(matchingAliases) == 1 {
+		if err := api.CheckOwnership(JoinDNSName(alias.HostName, alias.Domain), matchingAliases[0].Description); err != nil {
 			return err
 		}
-		if apiResp.Result != "saved" {
-			log.Printf("API returned error: %s", apiResp.Result)
-			return ErrApiReturnedError
-		}
-		return nil
+		alias.Uuid = matchingAliases[0].Uuid
+		log.Printf("Create: Host alias %s.%s already exists, trying to update\n", alias.HostName, alias.Domain)
+		return alias.Update(api)
+	}
+
+	reqBody := struct {
+		Alias *OpnSenseHostAlias `json:"alias"`
+	}{
+		Alias: alias,
+	}
+	log.Printf("Create: Creating DNS alias [CNAME] %s => %s\n", alias.HostName+"."+alias.Domain, alias.Host)
+
+	uuid, err := api.saveRequest("/unbound/settings/add_host_alias/", reqBody, ErrFailedToCreate)
+	if err != nil {
+		return err
 	}
+	alias.Uuid = uuid
+	return nil
 }
@@ -12,6 +12,7 @@ func (override *OpnSenseHostOverride) Delete(api *OpnSenseApi) error {
 	endpoint := fmt.Sprintf("/unbound/settings/del_host_override/%s", override.Uuid)
 
 	// Make the DELETE request
+	api.noteWrite()
 	resp, err := api.ApiRequest(http.MethodPost, endpoint, nil)
 	if err != nil {
 		return err
@@ -21,10 +22,31 @@ func (override *OpnSenseHostOverride) Delete(api *OpnSenseApi) error {
 	// Check the response status
 	if resp.StatusCode != http.StatusOK {
 		log.Printf("Failed to delete DNS entry with UUID %s, status code: %d\n", override.Uuid, resp.StatusCode)
-		return ErrFailedToDelete
+		return newAPIError(resp, ErrFailedToDelete)
 	}
 
 	// Log success
 	log.Printf("Successfully deleted DNS entry with UUID %s\n", override.Uuid)
 	return nil
 }
+
+func (alias *OpnSenseHostAlias) Delete(api *OpnSenseApi) error {
+
+	// Construct the API endpoint
+	endpoint := fmt.Sprintf("/unbound/settings/del_host_alias/%s", alias.Uuid)
+
+	api.noteWrite()
+	resp, err := api.ApiRequest(http.MethodPost, endpoint, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		log.Printf("Failed to delete DNS alias with UUID %s, status code: %d\n", alias.Uuid, resp.StatusCode)
+		return newAPIError(resp, ErrFailedToDelete)
+	}
+
+	log.Printf("Successfully deleted DNS alias with UUID %s\n", alias.Uuid)
+	return nil
+}
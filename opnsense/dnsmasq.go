@@ -0,0 +1,137 @@
+package opnsense
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// DnsmasqHost represents a host override of the Dnsmasq DNS service in OpnSense.
+// Ip may hold several comma separated addresses; entries created by this webhook hold exactly one.
+type DnsmasqHost struct {
+	Uuid        string `json:"uuid"`
+	HostName    string `json:"host"`
+	Domain      string `json:"domain"`
+	Ip          string `json:"ip"`
+	Description string `json:"descr"`
+}
+
+// Type returns the record type of the host override, derived from its first address.
+// Overrides holding several addresses may hold both types, see Addresses.
+func (host *DnsmasqHost) Type() string {
+	addresses := host.Addresses()
+	if len(addresses) == 0 {
+		return "A"
+	}
+	return AddressType(addresses[0])
+}
+
+// Addresses returns the addresses of the host override.
+func (host *DnsmasqHost) Addresses() []string {
+	addresses := []string{}
+	for _, ip := range strings.Split(host.Ip, ",") {
+		if ip = strings.TrimSpace(ip); ip != "" {
+			addresses = append(addresses, ip)
+		}
+	}
+	return addresses
+}
+
+// AddressType returns the record type of the address ip, AAAA for IPv6 and A otherwise.
+func AddressType(ip string) string {
+	if strings.Contains(ip, ":") {
+		return "AAAA"
+	}
+	return "A"
+}
+
+// SearchDnsmasqHosts returns the Dnsmasq host overrides matching searchPhrase.
+func SearchDnsmasqHosts(api *OpnSenseApi, searchPhrase string) ([]*DnsmasqHost, error) {
+	body := map[string]interface{}{
+		"current":      1,
+		"rowCount":     -1,
+		"sort":         map[string]interface{}{},
+		"searchPhrase": searchPhrase,
+	}
+	endpoint := "/dnsmasq/settings/search_host/"
+
+	jsonBody, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := api.ApiRequest(http.MethodPost, endpoint, bytes.NewReader(jsonBody))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		log.Printf("Request to %s failed, status code: %d\n", endpoint, resp.StatusCode)
+		return nil, newAPIError(resp, ErrFailedToRead)
+	}
+
+	var searchResponse struct {
+		Rows     []*DnsmasqHost `json:"rows"`
+		RowCount int            `json:"rowCount"`
+		Total    int            `json:"total"`
+		Current  int            `json:"current"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&searchResponse)
+	if err != nil {
+		return nil, err
+	}
+	return searchResponse.Rows, nil
+}
+
+// Add creates the Dnsmasq host override without checking for existing overrides.
+// On success the UUID of the new override is stored in host.Uuid.
+func (host *DnsmasqHost) Add(api *OpnSenseApi) error {
+	reqBody := struct {
+		Host *DnsmasqHost `json:"host"`
+	}{
+		Host: host,
+	}
+	log.Printf("Create: Creating dnsmasq entry [%s] %s => %s\n", host.Type(), JoinDNSName(host.HostName, host.Domain), host.Ip)
+
+	uuid, err := api.saveRequest("/dnsmasq/settings/add_host/", reqBody, ErrFailedToCreate)
+	if err != nil {
+		return err
+	}
+	host.Uuid = uuid
+	return nil
+}
+
+// Update writes all fields of host to the Dnsmasq host override with its UUID.
+func (host *DnsmasqHost) Update(api *OpnSenseApi) error {
+	endpoint := fmt.Sprintf("/dnsmasq/settings/set_host/%s", host.Uuid)
+	reqBody := struct {
+		Host *DnsmasqHost `json:"host"`
+	}{
+		Host: host,
+	}
+	_, err := api.saveRequest(endpoint, reqBody, ErrFailedToUpdate)
+	return err
+}
+
+// Delete removes the Dnsmasq host override with the UUID of host.
+func (host *DnsmasqHost) Delete(api *OpnSenseApi) error {
+	endpoint := fmt.Sprintf("/dnsmasq/settings/del_host/%s", host.Uuid)
+
+	api.noteWrite()
+	resp, err := api.ApiRequest(http.MethodPost, endpoint, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		log.Printf("Failed to delete dnsmasq entry with UUID %s, status code: %d\n", host.Uuid, resp.StatusCode)
+		return newAPIError(resp, ErrFailedToDelete)
+	}
+
+	log.Printf("Successfully deleted dnsmasq entry with UUID %s\n", host.Uuid)
+	return nil
+}
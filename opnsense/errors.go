@@ -2,10 +2,83 @@ package opnsense
 
 import (
 	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
 )
 
+var ErrFailedToRead = errors.New("failed to read dns entries")
 var ErrFailedToApply = errors.New("failed to apply changes on opnsense")
 var ErrFailedToCreate = errors.New("failed to create dns entry")
 var ErrFailedToUpdate = errors.New("failed to update dns entry")
 var ErrFailedToDelete = errors.New("failed to delete dns entry")
 var ErrApiReturnedError = errors.New("api returned an error")
+var ErrOwnershipConflict = errors.New("dns entry is not owned by this instance")
+var ErrAliasTargetNotFound = errors.New("no host override found for the alias target")
+
+// APIError is a failed request to the OpnSense API. It carries what the API answered, and matches
+// the sentinel error of the failed operation with errors.Is.
+type APIError struct {
+	Method string
+	Path   string
+	// StatusCode is the HTTP status of the response.
+	StatusCode int
+	// Result is the result or status string of the response body, e.g. "failed", if there was one.
+	Result string
+	// Validations maps fields to the messages of the OpnSense input validation, e.g. "host.hostname".
+	Validations map[string]string
+	// Err is the sentinel of the failed operation, like ErrFailedToCreate.
+	Err error
+}
+
+// newAPIError returns the APIError of the failed operation err for resp.
+func newAPIError(resp *http.Response, err error) *APIError {
+	apiErr := &APIError{
+		StatusCode: resp.StatusCode,
+		Err:        err,
+	}
+	if resp.Request != nil {
+		apiErr.Method = resp.Request.Method
+		apiErr.Path = resp.Request.URL.Path
+	}
+	return apiErr
+}
+
+// withResult adds the result and the validation messages of the response body to the error.
+func (e *APIError) withResult(result string, validations map[string]interface{}) *APIError {
+	e.Result = result
+	if len(validations) > 0 {
+		e.Validations = make(map[string]string, len(validations))
+		for field, message := range validations {
+			e.Validations[field] = fmt.Sprint(message)
+		}
+	}
+	return e
+}
+
+func (e *APIError) Error() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%v: %s %s returned status %d", e.Err, e.Method, e.Path, e.StatusCode)
+	if e.Result != "" {
+		fmt.Fprintf(&b, ", result %q", e.Result)
+	}
+	if len(e.Validations) > 0 {
+		messages := make([]string, 0, len(e.Validations))
+		for field, message := range e.Validations {
+			messages = append(messages, fmt.Sprintf("%s: %s", field, message))
+		}
+		sort.Strings(messages)
+		fmt.Fprintf(&b, ": %s", strings.Join(messages, "; "))
+	}
+	return b.String()
+}
+
+// Unwrap returns the sentinel of the failed operation, and ErrApiReturnedError if the API answered
+// with an error result instead of an error status.
+func (e *APIError) Unwrap() []error {
+	if e.Result != "" || len(e.Validations) > 0 {
+		return []error{e.Err, ErrApiReturnedError}
+	}
+	return []error{e.Err}
+}
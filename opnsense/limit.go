@@ -0,0 +1,139 @@
+package opnsense
+
+import (
+	"context"
+	"io"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// slowWait is the wait for the limiter above which a request is logged.
+const slowWait = time.Second
+
+// Limiter paces the requests to the OpnSense API with a token bucket and caps the number of
+// requests in flight, so big syncs do not slow down the firewall for its other users.
+// A Limiter is shared by all copies of an OpnSenseApi and safe for concurrent use.
+type Limiter struct {
+	rate  float64
+	burst float64
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+
+	inFlight chan struct{}
+
+	waits    atomic.Int64
+	waitTime atomic.Int64
+}
+
+// NewLimiter returns a limiter allowing rate requests per second with bursts of burst requests,
+// and at most maxInFlight requests at the same time. A rate or maxInFlight of zero disables the
+// respective limit.
+func NewLimiter(rate float64, burst, maxInFlight int) *Limiter {
+	l := &Limiter{
+		rate:  rate,
+		burst: float64(max(burst, 1)),
+	}
+	l.tokens = l.burst
+	if maxInFlight > 0 {
+		l.inFlight = make(chan struct{}, maxInFlight)
+	}
+	return l
+}
+
+// LimiterStats counts the requests that had to wait for the limiter.
+type LimiterStats struct {
+	// Waits is the number of requests that waited.
+	Waits int64
+	// WaitTime is the total time requests waited.
+	WaitTime time.Duration
+}
+
+// Stats returns the wait statistics since the limiter was created.
+func (l *Limiter) Stats() LimiterStats {
+	return LimiterStats{
+		Waits:    l.waits.Load(),
+		WaitTime: time.Duration(l.waitTime.Load()),
+	}
+}
+
+// Wait blocks until the request may be sent. On success, release must be called once the request
+// is done, including reading its response.
+func (l *Limiter) Wait(ctx context.Context) (release func(), err error) {
+	start := time.Now()
+	if err := l.waitToken(ctx); err != nil {
+		return nil, err
+	}
+	if l.inFlight != nil {
+		select {
+		case l.inFlight <- struct{}{}:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	waited := time.Since(start)
+	apiRateLimitWait.Observe(waited.Seconds())
+	if waited > time.Millisecond {
+		l.waits.Add(1)
+		l.waitTime.Add(int64(waited))
+		if waited > slowWait {
+			log.Printf("Request waited %s for the rate limiter, %d waits in total", waited.Round(time.Millisecond), l.waits.Load())
+		}
+	}
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			if l.inFlight != nil {
+				<-l.inFlight
+			}
+		})
+	}, nil
+}
+
+// waitToken takes a token from the bucket, waiting until one is available.
+func (l *Limiter) waitToken(ctx context.Context) error {
+	if l.rate <= 0 {
+		return nil
+	}
+	l.mu.Lock()
+	now := time.Now()
+	if !l.last.IsZero() {
+		l.tokens = min(l.burst, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	}
+	l.last = now
+	// Reserve the token now, so concurrent requests queue up behind each other
+	l.tokens--
+	wait := time.Duration(-l.tokens / l.rate * float64(time.Second))
+	l.mu.Unlock()
+	if wait <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		// Hand the reserved token back
+		l.mu.Lock()
+		l.tokens++
+		l.mu.Unlock()
+		return ctx.Err()
+	}
+}
+
+// releasingBody releases the limiter slot of its request when closed.
+type releasingBody struct {
+	io.ReadCloser
+	release func()
+}
+
+func (b releasingBody) Close() error {
+	defer b.release()
+	return b.ReadCloser.Close()
+}
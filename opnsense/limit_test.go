@@ -0,0 +1,72 @@
+package opnsense_test
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	opnsense "external-dns-opnsense/opnsense"
+	"external-dns-opnsense/opnsense/opnsensetest"
+)
+
+func TestLimiterRate(t *testing.T) {
+	srv := opnsensetest.NewServer()
+	defer srv.Close()
+	api := srv.Api().WithContext(context.Background())
+	api.Limiter = opnsense.NewLimiter(100, 1, 0)
+
+	// The first request uses the burst, the other ten wait 10ms each
+	start := time.Now()
+	for range 11 {
+		if _, err := opnsense.SearchHostOverrides(api, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 90*time.Millisecond {
+		t.Errorf("11 requests at 100/s took %s", elapsed)
+	}
+	if stats := api.Limiter.Stats(); stats.Waits == 0 || stats.WaitTime == 0 {
+		t.Errorf("limiter stats %+v, want waits", stats)
+	}
+}
+
+func TestLimiterInFlight(t *testing.T) {
+	srv := opnsensetest.NewServer()
+	defer srv.Close()
+	srv.Inject(opnsensetest.Fault{Latency: 50 * time.Millisecond})
+	api := srv.Api().WithContext(context.Background())
+	api.Limiter = opnsense.NewLimiter(0, 0, 1)
+
+	start := time.Now()
+	var wg sync.WaitGroup
+	for range 3 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := opnsense.SearchHostOverrides(api, ""); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if elapsed := time.Since(start); elapsed < 150*time.Millisecond {
+		t.Errorf("3 requests of 50ms one at a time took %s", elapsed)
+	}
+}
+
+func TestLimiterContext(t *testing.T) {
+	limiter := opnsense.NewLimiter(1, 1, 0)
+	release, err := limiter.Wait(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	release()
+
+	// The next token is due in a second, after the deadline
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := limiter.Wait(ctx); err == nil {
+		t.Error("Wait succeeded after the deadline")
+	}
+}
@@ -0,0 +1,78 @@
+package opnsense
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// metricsNamespace prefixes all metrics of the webhook.
+const metricsNamespace = "external_dns_opnsense"
+
+var (
+	apiRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "api",
+		Name:      "requests_total",
+		Help:      "Requests to the OpnSense API by endpoint, method and status code, \"error\" if no response was received.",
+	}, []string{"endpoint", "method", "status"})
+	apiRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "api",
+		Name:      "request_duration_seconds",
+		Help:      "Time until the OpnSense API answered a request, by endpoint and method.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"endpoint", "method"})
+	apiRateLimitWait = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "api",
+		Name:      "rate_limit_wait_seconds",
+		Help:      "Time requests waited for the rate limiter and the in-flight limit.",
+		Buckets:   []float64{0.001, 0.01, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10},
+	})
+	reconfigureDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "reconfigure",
+		Name:      "duration_seconds",
+		Help:      "Time to reconfigure a service until it was running again, including retries, by service.",
+		Buckets:   []float64{0.5, 1, 2.5, 5, 10, 20, 30, 60},
+	}, []string{"service"})
+	reconfigureFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "reconfigure",
+		Name:      "failures_total",
+		Help:      "Reconfigures that failed after all retries, by service.",
+	}, []string{"service"})
+	reconfigureSkipped = prometheus.NewCounterFunc(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "reconfigure",
+		Name:      "skipped_total",
+		Help:      "Reconfigures skipped because nothing was written.",
+	}, func() float64 { return float64(SkippedReconfigures()) })
+)
+
+func init() {
+	prometheus.MustRegister(apiRequests, apiRequestDuration, apiRateLimitWait, reconfigureDuration, reconfigureFailures, reconfigureSkipped)
+}
+
+// uuidPattern matches the UUIDs in endpoint paths.
+var uuidPattern = regexp.MustCompile(`[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}`)
+
+// endpointLabel returns the endpoint as metric label, with UUIDs replaced to keep the number of series bounded.
+func endpointLabel(endpoint string) string {
+	return strings.TrimSuffix(uuidPattern.ReplaceAllString(endpoint, ":uuid"), "/")
+}
+
+// observeRequest records a request to endpoint. status is 0 if no response was received.
+func observeRequest(endpoint, method string, status int, duration time.Duration) {
+	label := endpointLabel(endpoint)
+	statusLabel := "error"
+	if status != 0 {
+		statusLabel = strconv.Itoa(status)
+	}
+	apiRequests.WithLabelValues(label, method, statusLabel).Inc()
+	apiRequestDuration.WithLabelValues(label, method).Observe(duration.Seconds())
+}
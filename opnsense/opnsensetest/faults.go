@@ -0,0 +1,105 @@
+package opnsensetest
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+)
+
+// Fault describes a misbehaviour of the firewall, injected into the requests matching Path.
+// Latency is added before the request is handled; of the remaining fields the first one set
+// decides the answer, in the order Status, Validations, ReconfigureStatus, TruncateJSON.
+type Fault struct {
+	// Path selects the requests by a substring of their path, e.g. "add_host_override". Empty matches all requests.
+	Path string
+	// Times limits how often the fault fires. Zero fires it for every matching request.
+	Times int
+
+	// Latency delays the answer, or aborts it once the request context is done.
+	Latency time.Duration
+	// Status answers with this HTTP status instead of handling the request.
+	Status int
+	// Validations answers a save request with result "failed" and these field validations instead of handling it.
+	Validations map[string]string
+	// ReconfigureStatus answers a service reconfigure or status request with this status instead of "ok" or "running".
+	ReconfigureStatus string
+	// TruncateJSON handles the request, but cuts the response body in half.
+	// Writes therefore land on the server, while the client can not tell.
+	TruncateJSON bool
+
+	fired int
+}
+
+// Inject adds a fault. Faults are checked in the order they were injected, the first matching one fires.
+func (s *Server) Inject(fault Fault) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.faults = append(s.faults, &fault)
+}
+
+// ClearFaults removes all injected faults.
+func (s *Server) ClearFaults() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.faults = nil
+}
+
+// nextFault returns the fault to fire for the request path and counts it, or nil if none matches.
+func (s *Server) nextFault(path string) *Fault {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, fault := range s.faults {
+		if !strings.Contains(path, fault.Path) {
+			continue
+		}
+		if fault.Times > 0 && fault.fired >= fault.Times {
+			continue
+		}
+		fault.fired++
+		f := *fault
+		return &f
+	}
+	return nil
+}
+
+// inject applies the injected faults to matching requests.
+func (s *Server) inject(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fault := s.nextFault(r.URL.Path)
+		if fault == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if fault.Latency > 0 {
+			select {
+			case <-time.After(fault.Latency):
+			case <-r.Context().Done():
+				return
+			}
+		}
+		switch {
+		case fault.Status == http.StatusUnauthorized || fault.Status == http.StatusForbidden:
+			writeJSON(w, fault.Status, map[string]interface{}{"status": fault.Status, "message": http.StatusText(fault.Status)})
+		case fault.Status != 0:
+			// lighttpd answers server errors with an HTML page
+			w.Header().Set("Content-Type", "text/html")
+			w.WriteHeader(fault.Status)
+			_, _ = w.Write([]byte("<html><body><h1>" + http.StatusText(fault.Status) + "</h1></body></html>"))
+		case fault.Validations != nil:
+			writeJSON(w, http.StatusOK, map[string]interface{}{"result": "failed", "validations": fault.Validations})
+		case fault.ReconfigureStatus != "":
+			writeJSON(w, http.StatusOK, map[string]interface{}{"status": fault.ReconfigureStatus})
+		case fault.TruncateJSON:
+			rec := httptest.NewRecorder()
+			next.ServeHTTP(rec, r)
+			body := rec.Body.Bytes()
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(rec.Code)
+			_, _ = w.Write(bytes.Clone(body[:len(body)/2]))
+		default:
+			next.ServeHTTP(w, r)
+		}
+	})
+}
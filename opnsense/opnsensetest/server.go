@@ -0,0 +1,851 @@
+// Package opnsensetest provides an in-memory fake of the OpnSense API for tests and local development.
+//
+// The fake serves the Unbound host override and host alias endpoints, the Dnsmasq host endpoints, the BIND
+// zone and record endpoints and the service reconfigure and status endpoints with the response shapes of a real firewall, including validation errors, and records
+// every call it receives. Faults like latency, error statuses or broken responses can be injected
+// to test how clients cope with a misbehaving firewall.
+package opnsensetest
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	opnsense "external-dns-opnsense/opnsense"
+)
+
+// Credentials accepted by the fake server.
+const (
+	APIKey    = "opnsensetest-key"
+	APISecret = "opnsensetest-secret"
+)
+
+// Call is a request received by the fake server.
+type Call struct {
+	Method string
+	Path   string
+	Body   string
+	Status int
+}
+
+// Server is a fake OpnSense API backed by memory.
+type Server struct {
+	*httptest.Server
+
+	mu           sync.Mutex
+	nextID       int
+	overrides    map[string]*opnsense.OpnSenseHostOverride
+	aliases      map[string]*opnsense.OpnSenseHostAlias
+	hosts        map[string]*opnsense.DnsmasqHost
+	bindZones    map[string]*opnsense.BindZone
+	bindRecords  map[string]*opnsense.BindRecord
+	calls        []Call
+	reconfigures map[string]int
+	statuses     map[string]string
+	faults       []*Fault
+	client       *http.Client
+}
+
+// NewServer starts a fake OpnSense API. It must be closed with Close.
+func NewServer() *Server {
+	s := newServer()
+	s.Start()
+	return s
+}
+
+// NewTLSServer starts a fake OpnSense API serving HTTPS with a self-signed certificate, offering HTTP/2
+// like the firewall does. It must be closed with Close.
+func NewTLSServer() *Server {
+	s := newServer()
+	s.EnableHTTP2 = true
+	s.StartTLS()
+	return s
+}
+
+func newServer() *Server {
+	s := &Server{
+		overrides:    map[string]*opnsense.OpnSenseHostOverride{},
+		aliases:      map[string]*opnsense.OpnSenseHostAlias{},
+		hosts:        map[string]*opnsense.DnsmasqHost{},
+		bindZones:    map[string]*opnsense.BindZone{},
+		bindRecords:  map[string]*opnsense.BindRecord{},
+		reconfigures: map[string]int{},
+		statuses:     map[string]string{},
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/unbound/settings/search_host_override", s.searchHostOverrides)
+	mux.HandleFunc("/api/unbound/settings/get_host_override/", s.getHostOverride)
+	mux.HandleFunc("/api/unbound/settings/add_host_override", s.addHostOverride)
+	mux.HandleFunc("/api/unbound/settings/set_host_override/", s.setHostOverride)
+	mux.HandleFunc("/api/unbound/settings/del_host_override/", s.delHostOverride)
+	mux.HandleFunc("/api/unbound/settings/search_host_alias", s.searchHostAliases)
+	mux.HandleFunc("/api/unbound/settings/get_host_alias/", s.getHostAlias)
+	mux.HandleFunc("/api/unbound/settings/add_host_alias", s.addHostAlias)
+	mux.HandleFunc("/api/unbound/settings/set_host_alias/", s.setHostAlias)
+	mux.HandleFunc("/api/unbound/settings/del_host_alias/", s.delHostAlias)
+	mux.HandleFunc("/api/dnsmasq/settings/search_host/", s.searchDnsmasqHosts)
+	mux.HandleFunc("/api/dnsmasq/settings/add_host/", s.addDnsmasqHost)
+	mux.HandleFunc("/api/dnsmasq/settings/set_host/", s.setDnsmasqHost)
+	mux.HandleFunc("/api/dnsmasq/settings/del_host/", s.delDnsmasqHost)
+	mux.HandleFunc("/api/bind/domain/searchPrimaryDomain/", s.searchBindZones)
+	mux.HandleFunc("/api/bind/record/searchRecord/", s.searchBindRecords)
+	mux.HandleFunc("/api/bind/record/addRecord/", s.addBindRecord)
+	mux.HandleFunc("/api/bind/record/setRecord/", s.setBindRecord)
+	mux.HandleFunc("/api/bind/record/delRecord/", s.delBindRecord)
+	for _, service := range []string{"unbound", "dnsmasq", "bind"} {
+		mux.HandleFunc("/api/"+service+"/service/reconfigure", s.reconfigure)
+		mux.HandleFunc("/api/"+service+"/service/status", s.serviceStatus)
+	}
+	s.Server = httptest.NewUnstartedServer(s.record(s.inject(s.authenticate(mux))))
+	return s
+}
+
+// Api returns an API configuration talking to the fake server.
+// All configurations of a server share one HTTP client.
+func (s *Server) Api() *opnsense.OpnSenseApi {
+	s.mu.Lock()
+	if s.client == nil {
+		config := opnsense.DefaultClientConfig()
+		config.Timeout = 5 * time.Second
+		// The certificate of the TLS server is self-signed
+		config.TLSVerify = s.TLS == nil
+		s.client = opnsense.NewHTTPClient(config)
+	}
+	client := s.client
+	s.mu.Unlock()
+	return &opnsense.OpnSenseApi{
+		APIKey:       APIKey,
+		APISecret:    APISecret,
+		APIHost:      s.URL,
+		ApiTimeout:   5 * time.Second,
+		OwnerID:      "default",
+		ZoneFallback: opnsense.ZoneFallbackFirstLabel,
+		Backend:      opnsense.BackendUnbound,
+		TLSVerify:    s.TLS == nil,
+		Client:       client,
+	}
+}
+
+// AddHostOverride stores a copy of override as if it was created in the GUI and returns its UUID.
+func (s *Server) AddHostOverride(override opnsense.OpnSenseHostOverride) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	override.Uuid = s.newUUID()
+	s.overrides[override.Uuid] = &override
+	return override.Uuid
+}
+
+// AddHostAlias stores a copy of alias as if it was created in the GUI and returns its UUID.
+func (s *Server) AddHostAlias(alias opnsense.OpnSenseHostAlias) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	alias.Uuid = s.newUUID()
+	s.aliases[alias.Uuid] = &alias
+	return alias.Uuid
+}
+
+// AddDnsmasqHost stores a copy of host as if it was created in the GUI and returns its UUID.
+func (s *Server) AddDnsmasqHost(host opnsense.DnsmasqHost) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	host.Uuid = s.newUUID()
+	s.hosts[host.Uuid] = &host
+	return host.Uuid
+}
+
+// AddBindZone creates an enabled BIND primary zone named domain and returns its UUID.
+func (s *Server) AddBindZone(domain string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	zone := &opnsense.BindZone{Uuid: s.newUUID(), Enabled: "1", DomainName: domain}
+	s.bindZones[zone.Uuid] = zone
+	return zone.Uuid
+}
+
+// HostOverrides returns copies of all stored host overrides, ordered by UUID.
+func (s *Server) HostOverrides() []opnsense.OpnSenseHostOverride {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	overrides := make([]opnsense.OpnSenseHostOverride, 0, len(s.overrides))
+	for _, uuid := range sortedKeys(s.overrides) {
+		overrides = append(overrides, *s.overrides[uuid])
+	}
+	return overrides
+}
+
+// HostAliases returns copies of all stored host aliases, ordered by UUID.
+func (s *Server) HostAliases() []opnsense.OpnSenseHostAlias {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	aliases := make([]opnsense.OpnSenseHostAlias, 0, len(s.aliases))
+	for _, uuid := range sortedKeys(s.aliases) {
+		aliases = append(aliases, *s.aliases[uuid])
+	}
+	return aliases
+}
+
+// DnsmasqHosts returns copies of all stored Dnsmasq host overrides, ordered by UUID.
+func (s *Server) DnsmasqHosts() []opnsense.DnsmasqHost {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	hosts := make([]opnsense.DnsmasqHost, 0, len(s.hosts))
+	for _, uuid := range sortedKeys(s.hosts) {
+		hosts = append(hosts, *s.hosts[uuid])
+	}
+	return hosts
+}
+
+// BindRecords returns copies of all stored BIND records, ordered by UUID.
+func (s *Server) BindRecords() []opnsense.BindRecord {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	records := make([]opnsense.BindRecord, 0, len(s.bindRecords))
+	for _, uuid := range sortedKeys(s.bindRecords) {
+		records = append(records, *s.bindRecords[uuid])
+	}
+	return records
+}
+
+// Calls returns all requests received so far.
+func (s *Server) Calls() []Call {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Call(nil), s.calls...)
+}
+
+// Reconfigures returns how often the given service was reconfigured.
+func (s *Server) Reconfigures(service string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.reconfigures[service]
+}
+
+// Reset removes all records, recorded calls and injected faults.
+func (s *Server) Reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.overrides = map[string]*opnsense.OpnSenseHostOverride{}
+	s.aliases = map[string]*opnsense.OpnSenseHostAlias{}
+	s.hosts = map[string]*opnsense.DnsmasqHost{}
+	s.bindZones = map[string]*opnsense.BindZone{}
+	s.bindRecords = map[string]*opnsense.BindRecord{}
+	s.calls = nil
+	s.reconfigures = map[string]int{}
+	s.statuses = map[string]string{}
+	s.faults = nil
+}
+
+// SetServiceStatus sets the status the given service reports, e.g. "stopped". Services are "running" by default.
+func (s *Server) SetServiceStatus(service, status string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.statuses[service] = status
+}
+
+// statusRecorder captures the status code written by a handler.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// record stores every request in the call log, after the handler answered it.
+func (s *Server) record(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		r.Body = io.NopCloser(strings.NewReader(string(body)))
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+		s.mu.Lock()
+		s.calls = append(s.calls, Call{Method: r.Method, Path: r.URL.Path, Body: string(body), Status: rec.status})
+		s.mu.Unlock()
+	})
+}
+
+// authenticate rejects requests without the fake credentials like OpnSense does.
+func (s *Server) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key, secret, ok := r.BasicAuth()
+		if !ok || key != APIKey || secret != APISecret {
+			writeJSON(w, http.StatusUnauthorized, map[string]interface{}{"status": http.StatusUnauthorized, "message": "Authentication Failed"})
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (s *Server) searchHostOverrides(w http.ResponseWriter, r *http.Request) {
+	phrase := searchPhrase(r)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	rows := []*opnsense.OpnSenseHostOverride{}
+	for _, uuid := range sortedKeys(s.overrides) {
+		o := s.overrides[uuid]
+		if matches(phrase, o.HostName, o.Domain, o.Type, o.Server, o.Mx, o.TxtData, o.Description) {
+			rows = append(rows, o)
+		}
+	}
+	writeSearch(w, rows, len(rows))
+}
+
+func (s *Server) getHostOverride(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	o, ok := s.overrides[lastSegment(r)]
+	if !ok {
+		// OpnSense answers an empty array for unknown UUIDs
+		writeJSON(w, http.StatusOK, []interface{}{})
+		return
+	}
+	rr := map[string]interface{}{}
+	for _, t := range []struct{ value, label string }{{"A", "A (IPv4 address)"}, {"AAAA", "AAAA (IPv6 address)"}, {"MX", "MX (Mail server)"}, {"TXT", "TXT (Text records)"}} {
+		selected := 0
+		if o.Type == t.value {
+			selected = 1
+		}
+		rr[t.value] = map[string]interface{}{"value": t.label, "selected": selected}
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"host": map[string]interface{}{
+			"enabled":     o.Enabled,
+			"hostname":    o.HostName,
+			"domain":      o.Domain,
+			"rr":          rr,
+			"mxprio":      o.MxPrio,
+			"mx":          o.Mx,
+			"ttl":         o.TTL,
+			"server":      o.Server,
+			"txtdata":     o.TxtData,
+			"description": o.Description,
+		},
+	})
+}
+
+func (s *Server) addHostOverride(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Host map[string]string `json:"host"`
+	}
+	if !decodePost(w, r, &req) {
+		return
+	}
+	o := &opnsense.OpnSenseHostOverride{Enabled: "1"}
+	applyFields(o, req.Host)
+	if validations := validateHostOverride(o); len(validations) > 0 {
+		writeJSON(w, http.StatusOK, map[string]interface{}{"result": "failed", "validations": validations})
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	o.Uuid = s.newUUID()
+	s.overrides[o.Uuid] = o
+	writeJSON(w, http.StatusOK, map[string]interface{}{"result": "saved", "uuid": o.Uuid})
+}
+
+func (s *Server) setHostOverride(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Host map[string]string `json:"host"`
+	}
+	if !decodePost(w, r, &req) {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	current, ok := s.overrides[lastSegment(r)]
+	if !ok {
+		writeJSON(w, http.StatusOK, map[string]interface{}{"result": "failed"})
+		return
+	}
+	// Only the posted fields are changed, like OpnSense merges partial updates
+	o := *current
+	applyFields(&o, req.Host)
+	if validations := validateHostOverride(&o); len(validations) > 0 {
+		writeJSON(w, http.StatusOK, map[string]interface{}{"result": "failed", "validations": validations})
+		return
+	}
+	*current = o
+	writeJSON(w, http.StatusOK, map[string]interface{}{"result": "saved"})
+}
+
+func (s *Server) delHostOverride(w http.ResponseWriter, r *http.Request) {
+	if !requirePost(w, r) {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	uuid := lastSegment(r)
+	if _, ok := s.overrides[uuid]; !ok {
+		writeJSON(w, http.StatusOK, map[string]interface{}{"result": "not found"})
+		return
+	}
+	delete(s.overrides, uuid)
+	writeJSON(w, http.StatusOK, map[string]interface{}{"result": "deleted"})
+}
+
+func (s *Server) searchHostAliases(w http.ResponseWriter, r *http.Request) {
+	phrase := searchPhrase(r)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	rows := []*opnsense.OpnSenseHostAlias{}
+	for _, uuid := range sortedKeys(s.aliases) {
+		a := s.aliases[uuid]
+		if matches(phrase, a.HostName, a.Domain, a.Description) {
+			rows = append(rows, a)
+		}
+	}
+	writeSearch(w, rows, len(rows))
+}
+
+func (s *Server) getHostAlias(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	a, ok := s.aliases[lastSegment(r)]
+	if !ok {
+		writeJSON(w, http.StatusOK, []interface{}{})
+		return
+	}
+	hosts := map[string]interface{}{}
+	for uuid, o := range s.overrides {
+		selected := 0
+		if uuid == a.Host {
+			selected = 1
+		}
+		hosts[uuid] = map[string]interface{}{"value": opnsense.JoinDNSName(o.HostName, o.Domain), "selected": selected}
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"alias": map[string]interface{}{
+			"enabled":     a.Enabled,
+			"host":        hosts,
+			"hostname":    a.HostName,
+			"domain":      a.Domain,
+			"description": a.Description,
+		},
+	})
+}
+
+func (s *Server) addHostAlias(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Alias map[string]string `json:"alias"`
+	}
+	if !decodePost(w, r, &req) {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	a := &opnsense.OpnSenseHostAlias{Enabled: "1"}
+	applyFields(a, req.Alias)
+	if validations := s.validateHostAlias(a); len(validations) > 0 {
+		writeJSON(w, http.StatusOK, map[string]interface{}{"result": "failed", "validations": validations})
+		return
+	}
+	a.Uuid = s.newUUID()
+	s.aliases[a.Uuid] = a
+	writeJSON(w, http.StatusOK, map[string]interface{}{"result": "saved", "uuid": a.Uuid})
+}
+
+func (s *Server) setHostAlias(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Alias map[string]string `json:"alias"`
+	}
+	if !decodePost(w, r, &req) {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	current, ok := s.aliases[lastSegment(r)]
+	if !ok {
+		writeJSON(w, http.StatusOK, map[string]interface{}{"result": "failed"})
+		return
+	}
+	a := *current
+	applyFields(&a, req.Alias)
+	if validations := s.validateHostAlias(&a); len(validations) > 0 {
+		writeJSON(w, http.StatusOK, map[string]interface{}{"result": "failed", "validations": validations})
+		return
+	}
+	*current = a
+	writeJSON(w, http.StatusOK, map[string]interface{}{"result": "saved"})
+}
+
+func (s *Server) delHostAlias(w http.ResponseWriter, r *http.Request) {
+	if !requirePost(w, r) {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	uuid := lastSegment(r)
+	if _, ok := s.aliases[uuid]; !ok {
+		writeJSON(w, http.StatusOK, map[string]interface{}{"result": "not found"})
+		return
+	}
+	delete(s.aliases, uuid)
+	writeJSON(w, http.StatusOK, map[string]interface{}{"result": "deleted"})
+}
+
+func (s *Server) searchDnsmasqHosts(w http.ResponseWriter, r *http.Request) {
+	phrase := searchPhrase(r)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	rows := []*opnsense.DnsmasqHost{}
+	for _, uuid := range sortedKeys(s.hosts) {
+		h := s.hosts[uuid]
+		if matches(phrase, h.HostName, h.Domain, h.Ip, h.Description) {
+			rows = append(rows, h)
+		}
+	}
+	writeSearch(w, rows, len(rows))
+}
+
+func (s *Server) addDnsmasqHost(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Host map[string]string `json:"host"`
+	}
+	if !decodePost(w, r, &req) {
+		return
+	}
+	h := &opnsense.DnsmasqHost{}
+	applyFields(h, req.Host)
+	if validations := validateDnsmasqHost(h); len(validations) > 0 {
+		writeJSON(w, http.StatusOK, map[string]interface{}{"result": "failed", "validations": validations})
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	h.Uuid = s.newUUID()
+	s.hosts[h.Uuid] = h
+	writeJSON(w, http.StatusOK, map[string]interface{}{"result": "saved", "uuid": h.Uuid})
+}
+
+func (s *Server) setDnsmasqHost(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Host map[string]string `json:"host"`
+	}
+	if !decodePost(w, r, &req) {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	current, ok := s.hosts[lastSegment(r)]
+	if !ok {
+		writeJSON(w, http.StatusOK, map[string]interface{}{"result": "failed"})
+		return
+	}
+	h := *current
+	applyFields(&h, req.Host)
+	if validations := validateDnsmasqHost(&h); len(validations) > 0 {
+		writeJSON(w, http.StatusOK, map[string]interface{}{"result": "failed", "validations": validations})
+		return
+	}
+	*current = h
+	writeJSON(w, http.StatusOK, map[string]interface{}{"result": "saved"})
+}
+
+func (s *Server) delDnsmasqHost(w http.ResponseWriter, r *http.Request) {
+	if !requirePost(w, r) {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	uuid := lastSegment(r)
+	if _, ok := s.hosts[uuid]; !ok {
+		writeJSON(w, http.StatusOK, map[string]interface{}{"result": "not found"})
+		return
+	}
+	delete(s.hosts, uuid)
+	writeJSON(w, http.StatusOK, map[string]interface{}{"result": "deleted"})
+}
+
+func (s *Server) searchBindZones(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	rows := []*opnsense.BindZone{}
+	for _, uuid := range sortedKeys(s.bindZones) {
+		rows = append(rows, s.bindZones[uuid])
+	}
+	writeSearch(w, rows, len(rows))
+}
+
+func (s *Server) searchBindRecords(w http.ResponseWriter, r *http.Request) {
+	phrase := searchPhrase(r)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	rows := []*opnsense.BindRecord{}
+	for _, uuid := range sortedKeys(s.bindRecords) {
+		rec := s.bindRecords[uuid]
+		if matches(phrase, rec.Name, rec.Type, rec.Value) {
+			rows = append(rows, rec)
+		}
+	}
+	writeSearch(w, rows, len(rows))
+}
+
+func (s *Server) addBindRecord(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Record map[string]string `json:"record"`
+	}
+	if !decodePost(w, r, &req) {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	rec := &opnsense.BindRecord{Enabled: "1"}
+	applyFields(rec, req.Record)
+	if validations := s.validateBindRecord(rec); len(validations) > 0 {
+		writeJSON(w, http.StatusOK, map[string]interface{}{"result": "failed", "validations": validations})
+		return
+	}
+	rec.Uuid = s.newUUID()
+	s.bindRecords[rec.Uuid] = rec
+	writeJSON(w, http.StatusOK, map[string]interface{}{"result": "saved", "uuid": rec.Uuid})
+}
+
+func (s *Server) setBindRecord(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Record map[string]string `json:"record"`
+	}
+	if !decodePost(w, r, &req) {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	current, ok := s.bindRecords[lastSegment(r)]
+	if !ok {
+		writeJSON(w, http.StatusOK, map[string]interface{}{"result": "failed"})
+		return
+	}
+	rec := *current
+	applyFields(&rec, req.Record)
+	if validations := s.validateBindRecord(&rec); len(validations) > 0 {
+		writeJSON(w, http.StatusOK, map[string]interface{}{"result": "failed", "validations": validations})
+		return
+	}
+	*current = rec
+	writeJSON(w, http.StatusOK, map[string]interface{}{"result": "saved"})
+}
+
+func (s *Server) delBindRecord(w http.ResponseWriter, r *http.Request) {
+	if !requirePost(w, r) {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	uuid := lastSegment(r)
+	if _, ok := s.bindRecords[uuid]; !ok {
+		writeJSON(w, http.StatusOK, map[string]interface{}{"result": "not found"})
+		return
+	}
+	delete(s.bindRecords, uuid)
+	writeJSON(w, http.StatusOK, map[string]interface{}{"result": "deleted"})
+}
+
+func (s *Server) reconfigure(w http.ResponseWriter, r *http.Request) {
+	if !requirePost(w, r) {
+		return
+	}
+	s.mu.Lock()
+	s.reconfigures[service(r)]++
+	s.mu.Unlock()
+	writeJSON(w, http.StatusOK, map[string]interface{}{"status": "ok"})
+}
+
+func (s *Server) serviceStatus(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	status, ok := s.statuses[service(r)]
+	s.mu.Unlock()
+	if !ok {
+		status = "running"
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"status": status})
+}
+
+// newUUID returns a predictable UUID, so tests can refer to records by creation order.
+// The caller must hold s.mu.
+func (s *Server) newUUID() string {
+	s.nextID++
+	return fmt.Sprintf("00000000-0000-4000-8000-%012d", s.nextID)
+}
+
+// validateHostOverride mirrors the field validations of the Unbound host override model.
+func validateHostOverride(o *opnsense.OpnSenseHostOverride) map[string]string {
+	validations := map[string]string{}
+	if strings.ContainsAny(o.HostName, " _/") {
+		validations["host.hostname"] = "A valid hostname is required."
+	}
+	if o.Domain == "" || strings.ContainsAny(o.Domain, " _/") {
+		validations["host.domain"] = "A valid domain is required."
+	}
+	ip := net.ParseIP(o.Server)
+	switch o.Type {
+	case "A":
+		if ip == nil || ip.To4() == nil {
+			validations["host.server"] = "A valid IPv4 address is required."
+		}
+	case "AAAA":
+		if ip == nil || ip.To4() != nil {
+			validations["host.server"] = "A valid IPv6 address is required."
+		}
+	case "MX":
+		if o.Mx == "" {
+			validations["host.mx"] = "A mail server is required for MX records."
+		}
+	case "TXT":
+		if o.TxtData == "" {
+			validations["host.txtdata"] = "Text data is required for TXT records."
+		}
+	default:
+		validations["host.rr"] = "Option not in list."
+	}
+	return validations
+}
+
+// validateDnsmasqHost mirrors the field validations of the Dnsmasq host model.
+func validateDnsmasqHost(h *opnsense.DnsmasqHost) map[string]string {
+	validations := map[string]string{}
+	if strings.ContainsAny(h.HostName, " _/") {
+		validations["host.host"] = "A valid hostname is required."
+	}
+	if h.Domain == "" || strings.ContainsAny(h.Domain, " _/") {
+		validations["host.domain"] = "A valid domain is required."
+	}
+	for _, ip := range strings.Split(h.Ip, ",") {
+		if net.ParseIP(strings.TrimSpace(ip)) == nil {
+			validations["host.ip"] = "A valid IP address is required."
+		}
+	}
+	return validations
+}
+
+// validateBindRecord mirrors the field validations of the BIND record model. The caller must hold s.mu.
+func (s *Server) validateBindRecord(rec *opnsense.BindRecord) map[string]string {
+	validations := map[string]string{}
+	if _, ok := s.bindZones[rec.Domain]; !ok {
+		validations["record.domain"] = "Related item not found."
+	}
+	if rec.Name == "" || strings.ContainsAny(rec.Name, " /") {
+		validations["record.name"] = "A valid name is required."
+	}
+	if rec.Type == "" {
+		validations["record.type"] = "Option not in list."
+	}
+	if rec.Value == "" {
+		validations["record.value"] = "A value is required."
+	}
+	return validations
+}
+
+// validateHostAlias mirrors the field validations of the Unbound host alias model. The caller must hold s.mu.
+func (s *Server) validateHostAlias(a *opnsense.OpnSenseHostAlias) map[string]string {
+	validations := map[string]string{}
+	if _, ok := s.overrides[a.Host]; !ok {
+		validations["alias.host"] = "Related item not found."
+	}
+	if strings.ContainsAny(a.HostName, " _/") {
+		validations["alias.hostname"] = "A valid hostname is required."
+	}
+	if a.Domain == "" || strings.ContainsAny(a.Domain, " _/") {
+		validations["alias.domain"] = "A valid domain is required."
+	}
+	return validations
+}
+
+// applyFields sets the posted API fields on v, which is a host override or alias.
+func applyFields(v interface{}, fields map[string]string) {
+	current, _ := json.Marshal(v)
+	merged := map[string]string{}
+	_ = json.Unmarshal(current, &merged)
+	for field, value := range fields {
+		if field != "uuid" {
+			merged[field] = value
+		}
+	}
+	body, _ := json.Marshal(merged)
+	_ = json.Unmarshal(body, v)
+}
+
+// searchPhrase returns the search phrase of a grid search request.
+func searchPhrase(r *http.Request) string {
+	var req struct {
+		SearchPhrase string `json:"searchPhrase"`
+	}
+	_ = json.NewDecoder(r.Body).Decode(&req)
+	return req.SearchPhrase
+}
+
+// matches reports whether every word of phrase is contained in one of the fields, ignoring case.
+func matches(phrase string, fields ...string) bool {
+	for _, word := range strings.Fields(strings.ToLower(phrase)) {
+		found := false
+		for _, field := range fields {
+			if strings.Contains(strings.ToLower(field), word) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+func decodePost(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	if !requirePost(w, r) {
+		return false
+	}
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]interface{}{"status": http.StatusBadRequest, "message": "Invalid JSON"})
+		return false
+	}
+	return true
+}
+
+func requirePost(w http.ResponseWriter, r *http.Request) bool {
+	if r.Method != http.MethodPost {
+		writeJSON(w, http.StatusOK, map[string]interface{}{"result": "failed"})
+		return false
+	}
+	return true
+}
+
+func writeSearch[T any](w http.ResponseWriter, rows []T, total int) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"rows":     rows,
+		"rowCount": len(rows),
+		"total":    total,
+		"current":  1,
+	})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+// service returns the service of a request to /api/<service>/service/...
+func service(r *http.Request) string {
+	return strings.Split(strings.TrimPrefix(r.URL.Path, "/api/"), "/")[0]
+}
+
+func lastSegment(r *http.Request) string {
+	return r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:]
+}
+
+func sortedKeys[T any](m map[string]T) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,19 @@
+package opnsensetest
+
+import (
+	"testing"
+	"time"
+)
+
+// WaitUntil waits for cond, like a background reconfigure to reach the server, and fails the test
+// after a few seconds.
+func WaitUntil(t testing.TB, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met within 5s")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
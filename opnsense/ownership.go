@@ -0,0 +1,114 @@
+package opnsense
+
+import (
+	"fmt"
+	"log"
+	"strings"
+)
+
+// Policies for existing DNS entries that are not owned by this instance.
+const (
+	// ConflictRefuse never touches entries owned by someone else or by no one.
+	ConflictRefuse = "refuse"
+	// ConflictAdoptUnowned takes over entries with an empty description, but refuses entries of other owners.
+	ConflictAdoptUnowned = "adopt-unowned"
+	// ConflictAdopt takes over every entry, regardless of its owner.
+	ConflictAdopt = "adopt"
+)
+
+// descriptionMarker starts every description written by this webhook, followed by the format version.
+const descriptionMarker = "managed-by=external-dns"
+
+// descriptionVersion is the version of the description format written by this webhook.
+const descriptionVersion = "1"
+
+// descriptionEscaper escapes the separators of the description format in values.
+var descriptionEscaper = strings.NewReplacer("%", "%25", ";", "%3B", "=", "%3D")
+
+// descriptionUnescaper reverses descriptionEscaper.
+var descriptionUnescaper = strings.NewReplacer("%25", "%", "%3B", ";", "%3D", "=")
+
+// Ownership is the metadata stored in the description of a DNS entry managed by external-dns.
+type Ownership struct {
+	Owner    string
+	Resource string
+	Type     string
+	// Legacy is set if the description only held the bare owner ID and needs to be upgraded.
+	Legacy bool
+}
+
+// ParseDescription parses the description of a DNS entry. Descriptions without the managed-by
+// marker are legacy descriptions, which consist of the bare owner ID or are empty.
+func ParseDescription(description string) Ownership {
+	description = strings.TrimSpace(description)
+	if !IsManagedDescription(description) {
+		return Ownership{Owner: description, Legacy: description != ""}
+	}
+	ownership := Ownership{}
+	for _, field := range strings.Split(description, ";")[1:] {
+		key, value, _ := strings.Cut(strings.TrimSpace(field), "=")
+		value = descriptionUnescaper.Replace(value)
+		switch key {
+		case "owner":
+			ownership.Owner = value
+		case "resource":
+			ownership.Resource = value
+		case "type":
+			ownership.Type = value
+		}
+	}
+	return ownership
+}
+
+// Description returns the description of a DNS entry carrying the ownership, which stays readable in the OpnSense GUI:
+//
+//	managed-by=external-dns; v=1; owner=default; resource=ingress/default/web; type=A
+func (ownership Ownership) Description() string {
+	fields := []string{descriptionMarker, "v=" + descriptionVersion, "owner=" + descriptionEscaper.Replace(ownership.Owner)}
+	if ownership.Resource != "" {
+		fields = append(fields, "resource="+descriptionEscaper.Replace(ownership.Resource))
+	}
+	if ownership.Type != "" {
+		fields = append(fields, "type="+descriptionEscaper.Replace(ownership.Type))
+	}
+	return strings.Join(fields, "; ")
+}
+
+// IsManagedDescription reports whether description was written by this webhook in the structured format.
+func IsManagedDescription(description string) bool {
+	return strings.HasPrefix(strings.TrimSpace(description), descriptionMarker+";")
+}
+
+// OwnerOf returns the owner recorded in the description of a DNS entry, or an empty string if it is unowned.
+func OwnerOf(description string) string {
+	return ParseDescription(description).Owner
+}
+
+// Description returns the description for a DNS entry of the given record type created by this instance for resource.
+func (api *OpnSenseApi) Description(resource, recordType string) string {
+	return Ownership{Owner: api.OwnerID, Resource: resource, Type: recordType}.Description()
+}
+
+// CheckOwnership returns an error wrapping ErrOwnershipConflict if the existing entry name with the given
+// description must not be written by this instance according to the conflict policy.
+// Entries owned by OwnerID can always be written.
+func (api *OpnSenseApi) CheckOwnership(name, description string) error {
+	owner := OwnerOf(description)
+	if owner == api.OwnerID {
+		return nil
+	}
+	switch api.ConflictPolicy {
+	case ConflictAdopt:
+		log.Printf("Adopting %s from owner '%s'\n", name, owner)
+		return nil
+	case ConflictAdoptUnowned:
+		if owner == "" {
+			log.Printf("Adopting unowned %s\n", name)
+			return nil
+		}
+	}
+	if owner == "" {
+		return fmt.Errorf("%w: %s is not owned by %s", ErrOwnershipConflict, name, api.OwnerID)
+	}
+	return fmt.Errorf("%w: %s is owned by %s", ErrOwnershipConflict, name, owner)
+}
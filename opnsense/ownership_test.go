@@ -0,0 +1,124 @@
+package opnsense_test
+
+import (
+	"errors"
+	"testing"
+
+	opnsense "external-dns-opnsense/opnsense"
+)
+
+func TestParseDescription(t *testing.T) {
+	tests := []struct {
+		name        string
+		description string
+		want        opnsense.Ownership
+	}{
+		{"empty", "", opnsense.Ownership{}},
+		{"blank", "  ", opnsense.Ownership{}},
+		{"legacy owner", "default", opnsense.Ownership{Owner: "default", Legacy: true}},
+		{"legacy owner with spaces", " cluster-a ", opnsense.Ownership{Owner: "cluster-a", Legacy: true}},
+		{"legacy free text", "added by hand; do not touch", opnsense.Ownership{Owner: "added by hand; do not touch", Legacy: true}},
+		{"marker without separator", "managed-by=external-dns", opnsense.Ownership{Owner: "managed-by=external-dns", Legacy: true}},
+		{
+			"structured",
+			"managed-by=external-dns; v=1; owner=default; resource=ingress/default/web; type=A",
+			opnsense.Ownership{Owner: "default", Resource: "ingress/default/web", Type: "A"},
+		},
+		{"without resource", "managed-by=external-dns; v=1; owner=default; type=AAAA", opnsense.Ownership{Owner: "default", Type: "AAAA"}},
+		{"unknown fields", "managed-by=external-dns; v=2; owner=default; zone=example.com", opnsense.Ownership{Owner: "default"}},
+		{"without spaces", "managed-by=external-dns;v=1;owner=default;type=A", opnsense.Ownership{Owner: "default", Type: "A"}},
+		{"without owner", "managed-by=external-dns; v=1", opnsense.Ownership{}},
+		{
+			"escaped separators",
+			"managed-by=external-dns; v=1; owner=a%3Bb%3Dc%25d; resource=crd/x%3B owner%3Devil",
+			opnsense.Ownership{Owner: "a;b=c%d", Resource: "crd/x; owner=evil"},
+		},
+		{"double escape", "managed-by=external-dns; v=1; owner=a%253B", opnsense.Ownership{Owner: "a%3B"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := opnsense.ParseDescription(tt.description); got != tt.want {
+				t.Errorf("ParseDescription(%q) = %+v, want %+v", tt.description, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDescriptionRoundTrip(t *testing.T) {
+	tests := []struct {
+		name        string
+		ownership   opnsense.Ownership
+		description string
+	}{
+		{
+			"all fields",
+			opnsense.Ownership{Owner: "default", Resource: "ingress/default/web", Type: "A"},
+			"managed-by=external-dns; v=1; owner=default; resource=ingress/default/web; type=A",
+		},
+		{"owner only", opnsense.Ownership{Owner: "default"}, "managed-by=external-dns; v=1; owner=default"},
+		{"empty owner", opnsense.Ownership{Type: "TXT"}, "managed-by=external-dns; v=1; owner=; type=TXT"},
+		{
+			"separators in values",
+			opnsense.Ownership{Owner: "a;b", Resource: "x=y; owner=evil", Type: "A"},
+			"managed-by=external-dns; v=1; owner=a%3Bb; resource=x%3Dy%3B owner%3Devil; type=A",
+		},
+		{"percent in values", opnsense.Ownership{Owner: "100%3B"}, "managed-by=external-dns; v=1; owner=100%253B"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			description := tt.ownership.Description()
+			if description != tt.description {
+				t.Errorf("Description() = %q, want %q", description, tt.description)
+			}
+			if !opnsense.IsManagedDescription(description) {
+				t.Errorf("%q is not recognized as managed", description)
+			}
+			if got := opnsense.ParseDescription(description); got != tt.ownership {
+				t.Errorf("ParseDescription(%q) = %+v, want %+v", description, got, tt.ownership)
+			}
+		})
+	}
+}
+
+func TestCheckOwnership(t *testing.T) {
+	const (
+		own     = "managed-by=external-dns; v=1; owner=default; type=A"
+		other   = "managed-by=external-dns; v=1; owner=other; type=A"
+		legacy  = "default"
+		unowned = ""
+	)
+	tests := []struct {
+		policy      string
+		description string
+		wantErr     bool
+	}{
+		{opnsense.ConflictRefuse, own, false},
+		{opnsense.ConflictRefuse, legacy, false},
+		{opnsense.ConflictRefuse, unowned, true},
+		{opnsense.ConflictRefuse, other, true},
+		{opnsense.ConflictRefuse, "other", true},
+		{opnsense.ConflictAdoptUnowned, own, false},
+		{opnsense.ConflictAdoptUnowned, unowned, false},
+		{opnsense.ConflictAdoptUnowned, "  ", false},
+		{opnsense.ConflictAdoptUnowned, other, true},
+		{opnsense.ConflictAdoptUnowned, "other", true},
+		{opnsense.ConflictAdopt, own, false},
+		{opnsense.ConflictAdopt, unowned, false},
+		{opnsense.ConflictAdopt, other, false},
+		// An unknown policy refuses like the default
+		{"", unowned, true},
+		{"", other, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.policy+"/"+tt.description, func(t *testing.T) {
+			api := &opnsense.OpnSenseApi{OwnerID: "default", ConflictPolicy: tt.policy}
+			err := api.CheckOwnership("www.example.com", tt.description)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("CheckOwnership returned %v, want error %v", err, tt.wantErr)
+			}
+			if err != nil && !errors.Is(err, opnsense.ErrOwnershipConflict) {
+				t.Errorf("%v does not match %v", err, opnsense.ErrOwnershipConflict)
+			}
+		})
+	}
+}
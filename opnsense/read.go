@@ -3,41 +3,32 @@ package opnsense
 import (
 	"encoding/json"
 	"fmt"
+	"log"
 	"net/http"
 	"reflect"
 )
 
+// Read loads the host override from OpnSense. Without a Uuid, the override is looked up by
+// hostname, domain and record type, narrowed down by the target if one is set.
 func (override *OpnSenseHostOverride) Read(api *OpnSenseApi) error {
-	if override.Uuid == "" {
-		if override.HostName == "" || override.Domain == "" {
-			return fmt.Errorf("Read: Either Uuid or both HostName and Domain must be provided")
-		}
-		foundOverrides, err := SearchHostOverrides(api, fmt.Sprintf("%s %s", override.HostName, override.Domain))
-		if err != nil {
-			return err
-		}
-		if len(foundOverrides) == 0 {
-			return fmt.Errorf("Read: No host override found for %s.%s", override.HostName, override.Domain)
-		}
-		if len(foundOverrides) > 1 {
-			matchingOverrides := 0
-			for _, o := range foundOverrides {
-				if o.HostName == override.HostName && o.Domain == override.Domain {
-					matchingOverrides++
-				}
-			}
-			if matchingOverrides == 1 {
-				override.Uuid = foundOverrides[0].Uuid
-				return override.GetByUUID(api)
-			} else {
-				return fmt.Errorf("Read: Multiple host overrides found for %s.%s", override.HostName, override.Domain)
-			}
-		}
-		override.Uuid = foundOverrides[0].Uuid
-		return override.GetByUUID(api)
-	} else {
+	if override.Uuid != "" {
 		return override.GetByUUID(api)
 	}
+	if override.Domain == "" || override.Type == "" {
+		return fmt.Errorf("Read: Either Uuid or Domain and Type must be provided")
+	}
+	foundOverrides, err := FindHostOverrides(api, override.HostName, override.Domain, override.Type, override.Target())
+	if err != nil {
+		return err
+	}
+	if len(foundOverrides) == 0 {
+		return fmt.Errorf("Read: No [%s] host override found for %s.%s", override.Type, override.HostName, override.Domain)
+	}
+	if len(foundOverrides) > 1 {
+		return fmt.Errorf("Read: Multiple [%s] host overrides found for %s.%s", override.Type, override.HostName, override.Domain)
+	}
+	override.Uuid = foundOverrides[0].Uuid
+	return override.GetByUUID(api)
 }
 
 func (override *OpnSenseHostOverride) GetByUUID(api *OpnSenseApi) error {
@@ -79,6 +70,11 @@ func (override *OpnSenseHostOverride) GetByUUID(api *OpnSenseApi) error {
 	}
 	defer resp.Body.Close()
 
+	if resp.StatusCode != http.StatusOK {
+		log.Printf("Request to %s failed, status code: %d\n", endpoint, resp.StatusCode)
+		return newAPIError(resp, ErrFailedToRead)
+	}
+
 	err = json.NewDecoder(resp.Body).Decode(&reponseHost)
 	if err != nil {
 		return err
@@ -107,3 +103,50 @@ func (override *OpnSenseHostOverride) GetByUUID(api *OpnSenseApi) error {
 
 	return nil
 }
+
+func (alias *OpnSenseHostAlias) GetByUUID(api *OpnSenseApi) error {
+	endpoint := fmt.Sprintf("/unbound/settings/get_host_alias/%s", alias.Uuid)
+	var responseAlias struct {
+		Alias struct {
+			Enabled string `json:"enabled"`
+			Host    map[string]struct {
+				Value    string `json:"value"`
+				Selected int    `json:"selected"`
+			} `json:"host"`
+			HostName    string `json:"hostname"`
+			Domain      string `json:"domain"`
+			Description string `json:"description"`
+		} `json:"alias"`
+	}
+	resp, err := api.ApiRequest(http.MethodGet, endpoint, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		log.Printf("Request to %s failed, status code: %d\n", endpoint, resp.StatusCode)
+		return newAPIError(resp, ErrFailedToRead)
+	}
+
+	err = json.NewDecoder(resp.Body).Decode(&responseAlias)
+	if err != nil {
+		return err
+	}
+
+	// The parent host override is returned as a list of options, the selected one is the parent
+	parent := ""
+	for uuid, option := range responseAlias.Alias.Host {
+		if option.Selected == 1 {
+			parent = uuid
+			break
+		}
+	}
+	alias.Enabled = responseAlias.Alias.Enabled
+	alias.Host = parent
+	alias.HostName = responseAlias.Alias.HostName
+	alias.Domain = responseAlias.Alias.Domain
+	alias.Description = responseAlias.Alias.Description
+
+	return nil
+}
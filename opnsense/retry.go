@@ -0,0 +1,107 @@
+package opnsense
+
+import (
+	"context"
+	"errors"
+	"log"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// RetryPolicy configures how ApiRequest retries transient failures of the OpnSense API.
+//
+// Reads, i.e. GET requests and searches, are retried on network errors, 5xx responses and 429.
+// Writes are only retried if the firewall can not have applied them: if no connection could be
+// established, or if it answered 429 or 503 without handling the request. Anything else could
+// mean the write landed with its answer lost, so it is left to the next sync of external-dns.
+type RetryPolicy struct {
+	// MaxRetries is the number of retries of a single request. Zero disables retries.
+	MaxRetries int
+	// BaseDelay is the backoff before the first retry, doubled with every further retry.
+	BaseDelay time.Duration
+	// MaxDelay caps the backoff.
+	MaxDelay time.Duration
+	// Budget is the number of retries shared by all requests of a batch, see WithBatch.
+	// Zero means no limit besides MaxRetries.
+	Budget int
+}
+
+// DefaultRetryPolicy returns the retry policy used if none is set in the environment.
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxRetries: 3,
+		BaseDelay:  200 * time.Millisecond,
+		MaxDelay:   5 * time.Second,
+		Budget:     20,
+	}
+}
+
+// backoff returns the delay before the given retry, counted from 1. It uses full jitter: a random
+// delay up to the capped exponential backoff, so retries of concurrent requests spread out.
+func (p *RetryPolicy) backoff(retry int) time.Duration {
+	delay := p.BaseDelay
+	for i := 1; i < retry && delay < p.MaxDelay; i++ {
+		delay *= 2
+	}
+	delay = min(delay, p.MaxDelay)
+	if delay <= 0 {
+		return 0
+	}
+	return rand.N(delay + 1)
+}
+
+// isRead reports whether the request only reads from the firewall and may always be repeated.
+func isRead(method, endpoint string) bool {
+	if method == http.MethodGet {
+		return true
+	}
+	// Searches are posted, but do not change anything
+	return strings.Contains(endpoint, "/search")
+}
+
+// retryable reports whether a failed attempt may be repeated, given by either err or resp.
+func retryable(read bool, resp *http.Response, err error) bool {
+	if err != nil {
+		if read {
+			return true
+		}
+		// A write failed to connect did not reach the firewall
+		var opErr *net.OpError
+		return errors.As(err, &opErr) && opErr.Op == "dial"
+	}
+	switch {
+	case resp.StatusCode == http.StatusTooManyRequests, resp.StatusCode == http.StatusServiceUnavailable:
+		// The request was turned away before it was handled
+		return true
+	case resp.StatusCode >= http.StatusInternalServerError:
+		return read
+	default:
+		return false
+	}
+}
+
+// takeRetry uses a retry of the budget of the batch. It returns false if the budget is exhausted.
+func (api *OpnSenseApi) takeRetry(method, endpoint string) bool {
+	if api.batch != nil && !api.batch.takeRetry() {
+		log.Printf("Not retrying %s %s, the retry budget of %d is exhausted", method, endpoint, api.Retry.Budget)
+		return false
+	}
+	return true
+}
+
+// waitRetry waits before the given retry of a request. It fails if the context ends before the retry is due.
+func (api *OpnSenseApi) waitRetry(ctx context.Context, method, endpoint string, retry int, cause string) error {
+	delay := api.Retry.backoff(retry)
+	log.Printf("Retrying %s %s in %s (retry %d of %d) after %s", method, endpoint, delay.Round(time.Millisecond), retry, api.Retry.MaxRetries, cause)
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
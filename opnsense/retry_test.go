@@ -0,0 +1,145 @@
+package opnsense_test
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	opnsense "external-dns-opnsense/opnsense"
+	"external-dns-opnsense/opnsense/opnsensetest"
+)
+
+// newRetryServer starts a fake OpnSense API and returns an API configuration retrying quickly.
+func newRetryServer(t *testing.T, budget int) (*opnsensetest.Server, *opnsense.OpnSenseApi) {
+	t.Helper()
+	srv := opnsensetest.NewServer()
+	t.Cleanup(srv.Close)
+	api := srv.Api()
+	api.Retry = &opnsense.RetryPolicy{
+		MaxRetries: 3,
+		BaseDelay:  time.Millisecond,
+		MaxDelay:   5 * time.Millisecond,
+		Budget:     budget,
+	}
+	return srv, api.WithBatch().WithContext(context.Background())
+}
+
+// countCalls returns the number of requests to paths containing endpoint.
+func countCalls(srv *opnsensetest.Server, endpoint string) int {
+	n := 0
+	for _, call := range srv.Calls() {
+		if strings.Contains(call.Path, endpoint) {
+			n++
+		}
+	}
+	return n
+}
+
+func newOverride() *opnsense.OpnSenseHostOverride {
+	return &opnsense.OpnSenseHostOverride{
+		Enabled:  "1",
+		HostName: "www",
+		Domain:   "example.com",
+		Type:     "A",
+		Server:   "192.0.2.1",
+	}
+}
+
+func TestRetrySearch(t *testing.T) {
+	srv, api := newRetryServer(t, 0)
+	srv.Inject(opnsensetest.Fault{Path: "search_host_override", Times: 2, Status: http.StatusBadGateway})
+
+	if _, err := opnsense.SearchHostOverrides(api, ""); err != nil {
+		t.Fatalf("SearchHostOverrides: %v", err)
+	}
+	if got := countCalls(srv, "search_host_override"); got != 3 {
+		t.Errorf("searched %d times, want 3", got)
+	}
+}
+
+func TestRetryGiveUp(t *testing.T) {
+	srv, api := newRetryServer(t, 0)
+	srv.Inject(opnsensetest.Fault{Path: "get_host_override", Status: http.StatusInternalServerError})
+
+	override := &opnsense.OpnSenseHostOverride{Uuid: srv.AddHostOverride(*newOverride())}
+	if err := override.GetByUUID(api); err == nil {
+		t.Fatal("GetByUUID succeeded despite the fault")
+	}
+	if got := countCalls(srv, "get_host_override"); got != 4 {
+		t.Errorf("read %d times, want 4", got)
+	}
+}
+
+func TestRetryWrites(t *testing.T) {
+	tests := []struct {
+		name   string
+		status int
+		// calls is the number of add requests, stored the number of overrides afterwards
+		calls   int
+		stored  int
+		wantErr bool
+	}{
+		// The write may have landed, it must not be repeated
+		{"server error", http.StatusInternalServerError, 1, 0, true},
+		{"bad gateway", http.StatusBadGateway, 1, 0, true},
+		// The write was turned away, it is safe to repeat
+		{"service unavailable", http.StatusServiceUnavailable, 2, 1, false},
+		{"too many requests", http.StatusTooManyRequests, 2, 1, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv, api := newRetryServer(t, 0)
+			srv.Inject(opnsensetest.Fault{Path: "add_host_override", Times: 1, Status: tt.status})
+
+			err := newOverride().Add(api)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Add returned %v, want error %v", err, tt.wantErr)
+			}
+			if got := countCalls(srv, "add_host_override"); got != tt.calls {
+				t.Errorf("added %d times, want %d", got, tt.calls)
+			}
+			if got := len(srv.HostOverrides()); got != tt.stored {
+				t.Errorf("%d overrides stored, want %d", got, tt.stored)
+			}
+		})
+	}
+}
+
+func TestRetryUnreachable(t *testing.T) {
+	srv, api := newRetryServer(t, 0)
+	srv.Close()
+
+	// Nothing can have landed on a firewall that can not be reached, so writes are retried as well
+	start := time.Now()
+	if err := newOverride().Add(api); err == nil {
+		t.Fatal("Add succeeded without a server")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("retries took %s", elapsed)
+	}
+}
+
+func TestRetryBudget(t *testing.T) {
+	srv, api := newRetryServer(t, 2)
+	srv.Inject(opnsensetest.Fault{Path: "search_host_override", Status: http.StatusBadGateway})
+
+	// The first search uses up the budget of the batch, the second one is not retried at all
+	for range 2 {
+		if _, err := opnsense.SearchHostOverrides(api, ""); err == nil {
+			t.Fatal("SearchHostOverrides succeeded despite the fault")
+		}
+	}
+	if got := countCalls(srv, "search_host_override"); got != 4 {
+		t.Errorf("searched %d times, want 4", got)
+	}
+
+	// A new batch has a new budget
+	if _, err := opnsense.SearchHostOverrides(api.WithBatch(), ""); err == nil {
+		t.Fatal("SearchHostOverrides succeeded despite the fault")
+	}
+	if got := countCalls(srv, "search_host_override"); got != 7 {
+		t.Errorf("searched %d times, want 7", got)
+	}
+}
@@ -0,0 +1,114 @@
+package opnsense
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// ReconfigureScheduler coalesces the reconfigures of a service into one. A requested reconfigure
+// waits for Window without further requests, but at most MaxDelay after the first request of
+// the batch, so quick syncs or several external-dns instances share a single reconfigure.
+// A failed reconfigure is repeated after Window until one succeeds: the writes are already saved,
+// so the next sync of external-dns sees no difference and would not trigger another one.
+type ReconfigureScheduler struct {
+	api      *OpnSenseApi
+	service  string
+	window   time.Duration
+	maxDelay time.Duration
+	async    bool
+
+	mu      sync.Mutex
+	pending *pendingReconfigure
+	// err is the error of the last reconfigure, nil once one succeeded
+	err error
+	// running serializes the reconfigures, a batch only starts once the previous one finished
+	running sync.Mutex
+}
+
+// pendingReconfigure is a scheduled reconfigure, done is closed once it finished with err.
+type pendingReconfigure struct {
+	first time.Time
+	timer *time.Timer
+	done  chan struct{}
+	err   error
+}
+
+// NewReconfigureScheduler returns a scheduler reconfiguring service through api. In async mode,
+// Request returns right away and failed reconfigures are only logged.
+func NewReconfigureScheduler(api *OpnSenseApi, service string, window, maxDelay time.Duration, async bool) *ReconfigureScheduler {
+	return &ReconfigureScheduler{
+		api:      api,
+		service:  service,
+		window:   window,
+		maxDelay: max(maxDelay, window),
+		async:    async,
+	}
+}
+
+// Service returns the service the scheduler reconfigures.
+func (s *ReconfigureScheduler) Service() string {
+	return s.service
+}
+
+// Request schedules a reconfigure covering all writes made before the call. Unless the scheduler
+// is async, it waits for that reconfigure and returns its error.
+func (s *ReconfigureScheduler) Request() error {
+	s.mu.Lock()
+	p := s.pending
+	if p == nil {
+		p = s.schedule()
+	} else {
+		// Push the reconfigure back by a window, but not beyond the maximum delay
+		p.timer.Reset(min(s.window, p.first.Add(s.maxDelay).Sub(time.Now())))
+	}
+	s.mu.Unlock()
+
+	if s.async {
+		return nil
+	}
+	<-p.done
+	return p.err
+}
+
+// Err returns the error of the last reconfigure, or nil if it succeeded. A failed reconfigure is being retried.
+func (s *ReconfigureScheduler) Err() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+// schedule starts a new batch, reconfiguring after a window. The caller must hold s.mu.
+func (s *ReconfigureScheduler) schedule() *pendingReconfigure {
+	p := &pendingReconfigure{first: time.Now(), done: make(chan struct{})}
+	p.timer = time.AfterFunc(s.window, func() { s.fire(p) })
+	s.pending = p
+	return p
+}
+
+// fire runs the reconfigure of the pending batch p.
+func (s *ReconfigureScheduler) fire(p *pendingReconfigure) {
+	s.mu.Lock()
+	if s.pending != p {
+		// A reset timer of a batch that already ran
+		s.mu.Unlock()
+		return
+	}
+	s.pending = nil
+	s.mu.Unlock()
+
+	s.running.Lock()
+	defer s.running.Unlock()
+	log.Printf("Reconfigure: Running the reconfigure of %s scheduled %s ago\n", s.service, time.Since(p.first).Round(time.Millisecond))
+	p.err = s.api.Reconfigure(s.service)
+	s.mu.Lock()
+	s.err = p.err
+	if p.err != nil {
+		log.Printf("Reconfigure: Scheduled reconfigure of %s failed, retrying in %s: %v", s.service, s.window, p.err)
+		if s.pending == nil {
+			s.schedule()
+		}
+	}
+	s.mu.Unlock()
+	close(p.done)
+}
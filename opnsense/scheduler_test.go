@@ -0,0 +1,134 @@
+package opnsense_test
+
+import (
+	"errors"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	opnsense "external-dns-opnsense/opnsense"
+	"external-dns-opnsense/opnsense/opnsensetest"
+)
+
+func TestSchedulerCoalesces(t *testing.T) {
+	srv, api := newServiceServer(t)
+	// The window leaves the goroutines plenty of time to join the batch even on a loaded machine
+	scheduler := opnsense.NewReconfigureScheduler(api, "unbound", 200*time.Millisecond, time.Minute, false)
+
+	start := make(chan struct{})
+	var wg sync.WaitGroup
+	for range 5 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			if err := scheduler.Request(); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	close(start)
+	wg.Wait()
+	if got := srv.Reconfigures("unbound"); got != 1 {
+		t.Errorf("unbound reconfigured %d times, want 1", got)
+	}
+
+	// Requests after the reconfigure need a new one
+	if err := scheduler.Request(); err != nil {
+		t.Fatal(err)
+	}
+	if got := srv.Reconfigures("unbound"); got != 2 {
+		t.Errorf("unbound reconfigured %d times, want 2", got)
+	}
+}
+
+func TestSchedulerMaxDelay(t *testing.T) {
+	srv, api := newServiceServer(t)
+	scheduler := opnsense.NewReconfigureScheduler(api, "unbound", 50*time.Millisecond, 100*time.Millisecond, false)
+
+	var wg sync.WaitGroup
+	request := func() {
+		defer wg.Done()
+		if err := scheduler.Request(); err != nil {
+			t.Error(err)
+		}
+	}
+	first := make(chan struct{})
+	wg.Add(1)
+	go func() {
+		request()
+		close(first)
+	}()
+
+	// Requests every millisecond would push the reconfigure back forever without the maximum delay
+	deadline := time.After(5 * time.Second)
+	for waiting := true; waiting; {
+		select {
+		case <-first:
+			waiting = false
+		case <-deadline:
+			t.Fatal("the first request did not return within 5s of continuous requests")
+		case <-time.After(time.Millisecond):
+			wg.Add(1)
+			go request()
+		}
+	}
+	// Let the batches of the later requests finish before the server is closed
+	wg.Wait()
+	if got := srv.Reconfigures("unbound"); got == 0 {
+		t.Error("unbound was not reconfigured")
+	}
+}
+
+func TestSchedulerAsync(t *testing.T) {
+	srv, api := newServiceServer(t)
+	scheduler := opnsense.NewReconfigureScheduler(api, "unbound", 200*time.Millisecond, time.Minute, true)
+
+	// Request returns right away, long before the window passed
+	if err := scheduler.Request(); err != nil {
+		t.Fatal(err)
+	}
+	if got := srv.Reconfigures("unbound"); got != 0 {
+		t.Errorf("unbound reconfigured %d times before the window passed", got)
+	}
+	opnsensetest.WaitUntil(t, func() bool { return srv.Reconfigures("unbound") == 1 })
+}
+
+func TestSchedulerError(t *testing.T) {
+	srv, api := newServiceServer(t)
+	api.ReconfigureRetries = 0
+	srv.Inject(opnsensetest.Fault{Path: "reconfigure", ReconfigureStatus: "failed"})
+	api.Scheduler = opnsense.NewReconfigureScheduler(api, "unbound", 10*time.Millisecond, time.Second, false)
+
+	if err := api.WithBatch().Commit("unbound"); err != nil {
+		t.Errorf("Commit without writes returned %v", err)
+	}
+	if err := api.Commit("unbound"); !errors.Is(err, opnsense.ErrFailedToApply) {
+		t.Errorf("Commit returned %v, want %v", err, opnsense.ErrFailedToApply)
+	}
+	if err := api.Scheduler.Err(); !errors.Is(err, opnsense.ErrFailedToApply) {
+		t.Errorf("Err returned %v, want %v", err, opnsense.ErrFailedToApply)
+	}
+
+	// The failed reconfigure is repeated without another commit
+	srv.ClearFaults()
+	opnsensetest.WaitUntil(t, func() bool { return api.Scheduler.Err() == nil })
+	if got := srv.Reconfigures("unbound"); got != 1 {
+		t.Errorf("unbound reconfigured %d times, want 1", got)
+	}
+}
+
+func TestSchedulerAsyncRetry(t *testing.T) {
+	srv, api := newServiceServer(t)
+	api.ReconfigureRetries = 0
+	srv.Inject(opnsensetest.Fault{Path: "reconfigure", Times: 2, Status: http.StatusInternalServerError})
+	scheduler := opnsense.NewReconfigureScheduler(api, "unbound", 10*time.Millisecond, time.Second, true)
+
+	// The changes are saved, nothing else would activate them once the reconfigure failed
+	if err := scheduler.Request(); err != nil {
+		t.Fatal(err)
+	}
+	// Two failed attempts and a successful one
+	opnsensetest.WaitUntil(t, func() bool { return countCalls(srv, "reconfigure") == 3 && srv.Reconfigures("unbound") == 1 })
+}
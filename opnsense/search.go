@@ -3,7 +3,10 @@ package opnsense
 import (
 	"bytes"
 	"encoding/json"
+	"fmt"
+	"log"
 	"net/http"
+	"strings"
 )
 
 func SearchHostOverrides(api *OpnSenseApi, searchPhrase string) ([]*OpnSenseHostOverride, error) {
@@ -25,11 +28,53 @@ func SearchHostOverrides(api *OpnSenseApi, searchPhrase string) ([]*OpnSenseHost
 	}
 	defer resp.Body.Close()
 
+	if resp.StatusCode != http.StatusOK {
+		log.Printf("Request to %s failed, status code: %d\n", endpoint, resp.StatusCode)
+		return nil, newAPIError(resp, ErrFailedToRead)
+	}
+
 	var searchResponse struct {
 		Rows     []*OpnSenseHostOverride `json:"rows"`
-		RowCount int                    `json:"rowCount"`
-		Total    int                    `json:"total"`
-		Current  int                    `json:"current"`
+		RowCount int                     `json:"rowCount"`
+		Total    int                     `json:"total"`
+		Current  int                     `json:"current"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&searchResponse)
+	if err != nil {
+		return nil, err
+	}
+	return searchResponse.Rows, nil
+}
+
+func SearchHostAliases(api *OpnSenseApi, searchPhrase string) ([]*OpnSenseHostAlias, error) {
+	body := map[string]interface{}{
+		"current":      1,
+		"rowCount":     -1,
+		"sort":         map[string]interface{}{},
+		"searchPhrase": searchPhrase,
+	}
+	endpoint := "/unbound/settings/search_host_alias/"
+
+	jsonBody, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := api.ApiRequest(http.MethodPost, endpoint, bytes.NewReader(jsonBody))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		log.Printf("Request to %s failed, status code: %d\n", endpoint, resp.StatusCode)
+		return nil, newAPIError(resp, ErrFailedToRead)
+	}
+
+	var searchResponse struct {
+		Rows     []*OpnSenseHostAlias `json:"rows"`
+		RowCount int                  `json:"rowCount"`
+		Total    int                  `json:"total"`
+		Current  int                  `json:"current"`
 	}
 	err = json.NewDecoder(resp.Body).Decode(&searchResponse)
 	if err != nil {
@@ -37,3 +82,41 @@ func SearchHostOverrides(api *OpnSenseApi, searchPhrase string) ([]*OpnSenseHost
 	}
 	return searchResponse.Rows, nil
 }
+
+// FindHostOverrides returns the host overrides identified by hostname, domain and record type.
+// If target is not empty, only overrides with that target are returned.
+func FindHostOverrides(api *OpnSenseApi, hostname, domain, recordType, target string) ([]*OpnSenseHostOverride, error) {
+	foundOverrides, err := SearchHostOverrides(api, strings.TrimSpace(fmt.Sprintf("%s %s", hostname, domain)))
+	if err != nil {
+		return nil, err
+	}
+	matchingOverrides := []*OpnSenseHostOverride{}
+	for _, o := range foundOverrides {
+		if o.HostName != hostname || o.Domain != domain || o.Type != recordType {
+			continue
+		}
+		if target != "" && o.Target() != target {
+			continue
+		}
+		matchingOverrides = append(matchingOverrides, o)
+	}
+	return matchingOverrides, nil
+}
+
+// FindHostOverrideByName returns the first A or AAAA host override matching hostname and domain exactly.
+// It returns nil without an error if no such override exists.
+func FindHostOverrideByName(api *OpnSenseApi, hostname, domain string) (*OpnSenseHostOverride, error) {
+	foundOverrides, err := SearchHostOverrides(api, strings.TrimSpace(fmt.Sprintf("%s %s", hostname, domain)))
+	if err != nil {
+		return nil, err
+	}
+	for _, o := range foundOverrides {
+		if o.HostName != hostname || o.Domain != domain {
+			continue
+		}
+		if o.Type == "A" || o.Type == "AAAA" {
+			return o, nil
+		}
+	}
+	return nil, nil
+}
@@ -0,0 +1,140 @@
+package opnsense
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+)
+
+// ErrServiceNotRunning is returned if a service is not running after it was reconfigured.
+var ErrServiceNotRunning = errors.New("service is not running after reconfigure")
+
+// ApplyChanges activates the pending Unbound configuration.
+func (api *OpnSenseApi) ApplyChanges() error {
+	return api.Reconfigure("unbound")
+}
+
+// Reconfigure reloads the configuration of the given OpnSense service, e.g. "unbound" or "dnsmasq",
+// and checks that the service is running afterwards. A reconfigure only activates the saved
+// configuration, so failed attempts are repeated up to ReconfigureRetries times.
+// The retries and waits end with the context of api.
+func (api *OpnSenseApi) Reconfigure(service string) error {
+	start := time.Now()
+	var err error
+	for attempt := 0; attempt <= api.ReconfigureRetries; attempt++ {
+		if attempt > 0 {
+			log.Printf("Reconfigure: Retrying %s in %s (retry %d of %d) after: %v", service, api.ReconfigureRetryDelay, attempt, api.ReconfigureRetries, err)
+			if err = api.sleep(api.ReconfigureRetryDelay); err != nil {
+				break
+			}
+		}
+		if err = api.reconfigure(service); err != nil {
+			continue
+		}
+		if err = api.waitRunning(service); err == nil {
+			reconfigureDuration.WithLabelValues(service).Observe(time.Since(start).Seconds())
+			log.Printf("Reconfigure: %s is running with the new configuration after %s\n", service, time.Since(start).Round(time.Millisecond))
+			return nil
+		}
+	}
+	reconfigureDuration.WithLabelValues(service).Observe(time.Since(start).Seconds())
+	reconfigureFailures.WithLabelValues(service).Inc()
+	log.Printf("Reconfigure: Failed to apply the changes to %s: %v", service, err)
+	return err
+}
+
+// reconfigure posts a single reconfigure request for service.
+func (api *OpnSenseApi) reconfigure(service string) error {
+	var applyResponse struct {
+		Status string `json:"status"`
+	}
+	resp, err := api.ApiRequest(http.MethodPost, "/"+service+"/service/reconfigure", nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		log.Printf("API returned status code %d during apply changes", resp.StatusCode)
+		return newAPIError(resp, ErrFailedToApply)
+	}
+
+	err = json.NewDecoder(resp.Body).Decode(&applyResponse)
+	if err != nil {
+		return err
+	}
+	if applyResponse.Status != "ok" {
+		log.Printf("API returned error during apply changes: %s", applyResponse.Status)
+		return newAPIError(resp, ErrFailedToApply).withResult(applyResponse.Status, nil)
+	}
+	return nil
+}
+
+// waitRunning checks that service is running, giving a restarting service ReconfigureRetryDelay to come up.
+func (api *OpnSenseApi) waitRunning(service string) error {
+	err := api.checkRunning(service)
+	if err != nil && errors.Is(err, ErrServiceNotRunning) {
+		if err := api.sleep(api.ReconfigureRetryDelay); err != nil {
+			return err
+		}
+		err = api.checkRunning(service)
+	}
+	return err
+}
+
+// sleep waits for d. It fails with the error of the context of api if that ends first.
+func (api *OpnSenseApi) sleep(d time.Duration) error {
+	ctx := api.Ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// checkRunning fails with ErrServiceNotRunning unless the status of service is "running".
+func (api *OpnSenseApi) checkRunning(service string) error {
+	status, resp, err := api.serviceStatus(service)
+	if err != nil {
+		return err
+	}
+	if status != "running" {
+		log.Printf("Service %s is %s after reconfigure", service, status)
+		return newAPIError(resp, ErrServiceNotRunning).withResult(status, nil)
+	}
+	return nil
+}
+
+// ServiceStatus returns the status of the given OpnSense service, e.g. "running" or "stopped".
+func (api *OpnSenseApi) ServiceStatus(service string) (string, error) {
+	status, _, err := api.serviceStatus(service)
+	return status, err
+}
+
+func (api *OpnSenseApi) serviceStatus(service string) (string, *http.Response, error) {
+	var statusResponse struct {
+		Status string `json:"status"`
+	}
+	resp, err := api.ApiRequest(http.MethodGet, "/"+service+"/service/status", nil)
+	if err != nil {
+		return "", nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", resp, newAPIError(resp, ErrFailedToRead)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&statusResponse); err != nil {
+		return "", resp, err
+	}
+	return statusResponse.Status, resp, nil
+}
@@ -0,0 +1,86 @@
+package opnsense_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	opnsense "external-dns-opnsense/opnsense"
+	"external-dns-opnsense/opnsense/opnsensetest"
+)
+
+// newServiceServer starts a fake OpnSense API and returns an API configuration retrying reconfigures quickly.
+func newServiceServer(t *testing.T) (*opnsensetest.Server, *opnsense.OpnSenseApi) {
+	t.Helper()
+	srv := opnsensetest.NewServer()
+	t.Cleanup(srv.Close)
+	api := srv.Api()
+	api.ReconfigureRetries = 2
+	api.ReconfigureRetryDelay = time.Millisecond
+	return srv, api
+}
+
+func TestReconfigure(t *testing.T) {
+	tests := []struct {
+		name  string
+		fault opnsensetest.Fault
+		// reconfigures is the number of successful reconfigures
+		reconfigures int
+		wantErr      error
+	}{
+		{"ok", opnsensetest.Fault{}, 1, nil},
+		{"transient error status", opnsensetest.Fault{Path: "reconfigure", Times: 2, Status: http.StatusInternalServerError}, 1, nil},
+		{"error status", opnsensetest.Fault{Path: "reconfigure", Status: http.StatusInternalServerError}, 0, opnsense.ErrFailedToApply},
+		{"failed", opnsensetest.Fault{Path: "reconfigure", ReconfigureStatus: "failed"}, 0, opnsense.ErrFailedToApply},
+		// A restarting service gets a moment to come up
+		{"restarting", opnsensetest.Fault{Path: "status", Times: 1, ReconfigureStatus: "stopped"}, 1, nil},
+		{"not running", opnsensetest.Fault{Path: "status", ReconfigureStatus: "stopped"}, 3, opnsense.ErrServiceNotRunning},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv, api := newServiceServer(t)
+			srv.Inject(tt.fault)
+
+			err := api.ApplyChanges()
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("ApplyChanges returned %v, want %v", err, tt.wantErr)
+			}
+			if got := srv.Reconfigures("unbound"); got != tt.reconfigures {
+				t.Errorf("unbound reconfigured %d times, want %d", got, tt.reconfigures)
+			}
+		})
+	}
+}
+
+func TestServiceStatus(t *testing.T) {
+	srv, api := newServiceServer(t)
+	srv.SetServiceStatus("unbound", "stopped")
+
+	status, err := api.ServiceStatus("unbound")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != "stopped" {
+		t.Errorf("ServiceStatus returned %q, want stopped", status)
+	}
+}
+
+func TestReconfigureContext(t *testing.T) {
+	srv, api := newServiceServer(t)
+	api.ReconfigureRetryDelay = time.Minute
+	srv.Inject(opnsensetest.Fault{Path: "status", ReconfigureStatus: "stopped"})
+
+	// The request of external-dns gives up long before the retries are done
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err := api.WithContext(ctx).Reconfigure("unbound")
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Reconfigure returned %v, want %v", err, context.DeadlineExceeded)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Reconfigure returned after %s", elapsed)
+	}
+}
@@ -2,6 +2,10 @@ package opnsense
 
 import (
 	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
 	"time"
 )
 
@@ -20,6 +24,13 @@ type OpnSenseHostOverride struct {
 	Description string `json:"description"`
 }
 
+// Names of the DNS services records can be managed in.
+const (
+	BackendUnbound = "unbound"
+	BackendDnsmasq = "dnsmasq"
+	BackendBind    = "bind"
+)
+
 // OpnSenseApi represents the API configuration for interacting with the OpnSense API.
 type OpnSenseApi struct {
 	Ctx             context.Context
@@ -28,6 +39,89 @@ type OpnSenseApi struct {
 	APIHost         string
 	ApiTimeout      time.Duration
 	OwnerID         string
+	ConflictPolicy  string
+	IncludeUnowned  bool
+	Backend         string
 	DNSDomainFilter []string
+	Zones           []string
+	ZoneFallback    string
 	TLSVerify       bool
+	// Client is shared by all requests, see NewHTTPClient
+	Client *http.Client
+	// Retry configures retries of failed requests, nil disables them
+	Retry *RetryPolicy
+	batch *batch
+	// Limiter paces the requests, nil disables it
+	Limiter *Limiter
+	// ReconfigureRetries is the number of retries of a failed service reconfigure,
+	// ReconfigureRetryDelay the time between them and for a restarting service to come up
+	ReconfigureRetries    int
+	ReconfigureRetryDelay time.Duration
+	// Scheduler coalesces the reconfigures of Commit, nil reconfigures on every commit
+	Scheduler *ReconfigureScheduler
+}
+
+// OpnSenseHostAlias represents an alias of a DNS host override in OpnSense.
+// Host holds the UUID of the parent host override the alias points to.
+type OpnSenseHostAlias struct {
+	Uuid        string `json:"uuid"`
+	Enabled     string `json:"enabled"`
+	Host        string `json:"host"`
+	HostName    string `json:"hostname"`
+	Domain      string `json:"domain"`
+	Description string `json:"description"`
+}
+
+// Target returns the record data of the host override matching its record type.
+// MX targets are returned as "<priority> <exchange>".
+func (override *OpnSenseHostOverride) Target() string {
+	switch override.Type {
+	case "TXT":
+		return override.TxtData
+	case "MX":
+		return override.MxPrio + " " + override.Mx
+	default:
+		return override.Server
+	}
+}
+
+// SetTarget stores target in the fields of the host override matching its record type.
+// MX targets are expected as "<priority> <exchange>", see ParseMXTarget.
+func (override *OpnSenseHostOverride) SetTarget(target string) {
+	switch override.Type {
+	case "TXT":
+		override.TxtData = target
+	case "MX":
+		override.MxPrio, override.Mx, _ = ParseMXTarget(target)
+	default:
+		override.Server = target
+	}
+}
+
+// ParseMXTarget splits an MX target of the form "<priority> <exchange>" into its priority and exchange.
+// The trailing dot of the exchange is removed.
+func ParseMXTarget(target string) (string, string, error) {
+	parts := strings.Fields(target)
+	if len(parts) != 2 {
+		return "", "", fmt.Errorf("invalid MX target %q: expected \"<priority> <exchange>\"", target)
+	}
+	priority, err := strconv.ParseUint(parts[0], 10, 16)
+	if err != nil {
+		return "", "", fmt.Errorf("invalid MX target %q: priority must be between 0 and 65535", target)
+	}
+	exchange := strings.TrimSuffix(parts[1], ".")
+	if exchange == "" {
+		return "", "", fmt.Errorf("invalid MX target %q: exchange is empty", target)
+	}
+	return strconv.FormatUint(priority, 10), exchange, nil
+}
+
+// CanonicalMXTarget returns an MX target in the form Target reports it once stored:
+// the priority without leading zeros and the exchange without the trailing dot.
+func CanonicalMXTarget(target string) (string, error) {
+	priority, exchange, err := ParseMXTarget(target)
+	if err != nil {
+		return "", err
+	}
+	return priority + " " + exchange, nil
 }
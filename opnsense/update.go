@@ -1,11 +1,9 @@
 package opnsense
 
 import (
-	"bytes"
 	"encoding/json"
 	"fmt"
 	"log"
-	"net/http"
 )
 
 func (override *OpnSenseHostOverride) Update(api *OpnSenseApi) error {
@@ -15,33 +13,63 @@ func (override *OpnSenseHostOverride) Update(api *OpnSenseApi) error {
 	}{
 		Host: override,
 	}
-	jsonBody, err := json.Marshal(reqBody)
-	if err != nil {
-		return err
-	}
+	_, err := api.saveRequest(endpoint, reqBody, ErrFailedToUpdate)
+	return err
+}
 
-	resp, err := api.ApiRequest(http.MethodPost, endpoint, bytes.NewReader(jsonBody))
-	if err != nil {
-		return err
+// Changes returns the API fields of override whose values differ from current.
+// The UUID is not considered a field, as it identifies the override.
+func (override *OpnSenseHostOverride) Changes(current *OpnSenseHostOverride) map[string]string {
+	desired := override.fields()
+	existing := current.fields()
+	changes := map[string]string{}
+	for field, value := range desired {
+		if field != "uuid" && existing[field] != value {
+			changes[field] = value
+		}
 	}
-	defer resp.Body.Close()
+	return changes
+}
 
-	if resp.StatusCode != http.StatusOK {
-		log.Printf("Failed to update DNS entry with UUID %s, status code: %d\n", override.Uuid, resp.StatusCode)
-		return ErrFailedToUpdate
-	}
+// fields returns the host override as map of API field names to values.
+func (override *OpnSenseHostOverride) fields() map[string]string {
+	fields := map[string]string{}
+	// All fields are strings, so this round trip can not fail
+	jsonBody, _ := json.Marshal(override)
+	_ = json.Unmarshal(jsonBody, &fields)
+	return fields
+}
 
-	// check if the response contains an error message
-	var apiResp struct {
-		Result string `json:"result"`
+// UpdateChanges writes the fields of override that differ from current to the host override of current.
+// Nothing is sent if both are equal.
+func (override *OpnSenseHostOverride) UpdateChanges(api *OpnSenseApi, current *OpnSenseHostOverride) error {
+	changes := override.Changes(current)
+	if len(changes) == 0 {
+		log.Printf("Update: Host override %s is up to date\n", current.Uuid)
+		return nil
 	}
-	err = json.NewDecoder(resp.Body).Decode(&apiResp)
+	log.Printf("Update: Updating host override %s with %v\n", current.Uuid, changes)
+	endpoint := fmt.Sprintf("/unbound/settings/set_host_override/%s", current.Uuid)
+	reqBody := struct {
+		Host map[string]string `json:"host"`
+	}{
+		Host: changes,
+	}
+	_, err := api.saveRequest(endpoint, reqBody, ErrFailedToUpdate)
 	if err != nil {
 		return err
 	}
-	if apiResp.Result != "saved" {
-		log.Printf("API returned error: %s", apiResp.Result)
-		return ErrApiReturnedError
-	}
+	override.Uuid = current.Uuid
 	return nil
 }
+
+func (alias *OpnSenseHostAlias) Update(api *OpnSenseApi) error {
+	endpoint := fmt.Sprintf("/unbound/settings/set_host_alias/%s", alias.Uuid)
+	reqBody := struct {
+		Alias *OpnSenseHostAlias `json:"alias"`
+	}{
+		Alias: alias,
+	}
+	_, err := api.saveRequest(endpoint, reqBody, ErrFailedToUpdate)
+	return err
+}
@@ -0,0 +1,67 @@
+package opnsense
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Policies for names that do not belong to any configured zone.
+const (
+	// ZoneFallbackFirstLabel uses the first label as hostname and the rest of the name as domain.
+	ZoneFallbackFirstLabel = "first-label"
+	// ZoneFallbackReject refuses to handle the name.
+	ZoneFallbackReject = "reject"
+)
+
+// SplitDNSName splits a DNS name into the hostname and domain of a host override.
+// The domain is the longest configured zone the name belongs to, the zones being DNS_ZONES
+// or, if unset, the domain filter. The hostname is empty for the apex of a zone.
+// Names outside of all zones are handled according to ZoneFallback.
+func (api *OpnSenseApi) SplitDNSName(name string) (string, string, error) {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	if zone := api.FindZone(name); zone != "" {
+		if name == zone {
+			return "", zone, nil
+		}
+		return strings.TrimSuffix(name, "."+zone), zone, nil
+	}
+
+	switch api.ZoneFallback {
+	case ZoneFallbackReject:
+		return "", "", fmt.Errorf("DNS name %s does not belong to any configured zone", name)
+	default:
+		parts := strings.SplitN(name, ".", 2)
+		if len(parts) < 2 || parts[0] == "" || parts[1] == "" {
+			return "", "", fmt.Errorf("invalid DNSName: %s", name)
+		}
+		return parts[0], parts[1], nil
+	}
+}
+
+// FindZone returns the longest configured zone name belongs to, or an empty string if there is none.
+func (api *OpnSenseApi) FindZone(name string) string {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	zones := api.Zones
+	if len(zones) == 0 {
+		zones = api.DNSDomainFilter
+	}
+	match := ""
+	for _, zone := range zones {
+		zone = strings.ToLower(strings.Trim(strings.TrimSpace(zone), "."))
+		if zone == "" || len(zone) <= len(match) {
+			continue
+		}
+		if name == zone || strings.HasSuffix(name, "."+zone) {
+			match = zone
+		}
+	}
+	return match
+}
+
+// JoinDNSName returns the DNS name of a host override from its hostname and domain.
+func JoinDNSName(hostname, domain string) string {
+	if hostname == "" {
+		return domain
+	}
+	return hostname + "." + domain
+}
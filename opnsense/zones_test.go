@@ -0,0 +1,71 @@
+package opnsense_test
+
+import (
+	"testing"
+
+	opnsense "external-dns-opnsense/opnsense"
+)
+
+func TestSplitDNSName(t *testing.T) {
+	tests := []struct {
+		name     string
+		zones    []string
+		filter   []string
+		fallback string
+		dnsName  string
+		hostname string
+		domain   string
+		wantErr  bool
+	}{
+		{name: "single zone", zones: []string{"example.com"}, dnsName: "www.example.com", hostname: "www", domain: "example.com"},
+		{name: "nested hostname", zones: []string{"example.com"}, dnsName: "a.b.example.com", hostname: "a.b", domain: "example.com"},
+		{name: "longest zone wins", zones: []string{"example.com", "lab.example.com"}, dnsName: "www.lab.example.com", hostname: "www", domain: "lab.example.com"},
+		{name: "longest zone listed first", zones: []string{"lab.example.com", "example.com"}, dnsName: "www.lab.example.com", hostname: "www", domain: "lab.example.com"},
+		{name: "zone apex", zones: []string{"example.com"}, dnsName: "example.com", hostname: "", domain: "example.com"},
+		{name: "trailing dot and case", zones: []string{"Example.COM."}, dnsName: "WWW.example.com.", hostname: "www", domain: "example.com"},
+		{name: "suffix is no zone", zones: []string{"ample.com"}, dnsName: "www.example.com", hostname: "www", domain: "example.com"},
+		{name: "domain filter as zones", filter: []string{"example.com"}, dnsName: "a.b.example.com", hostname: "a.b", domain: "example.com"},
+		{name: "zones before domain filter", zones: []string{"b.example.com"}, filter: []string{"example.com"}, dnsName: "a.b.example.com", hostname: "a", domain: "b.example.com"},
+		{name: "first label fallback", zones: []string{"example.com"}, dnsName: "a.b.example.org", hostname: "a", domain: "b.example.org"},
+		{name: "explicit first label fallback", fallback: opnsense.ZoneFallbackFirstLabel, dnsName: "www.example.org", hostname: "www", domain: "example.org"},
+		{name: "single label", dnsName: "localhost", wantErr: true},
+		{name: "reject fallback", zones: []string{"example.com"}, fallback: opnsense.ZoneFallbackReject, dnsName: "www.example.org", wantErr: true},
+		{name: "reject fallback inside zone", zones: []string{"example.com"}, fallback: opnsense.ZoneFallbackReject, dnsName: "www.example.com", hostname: "www", domain: "example.com"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			api := &opnsense.OpnSenseApi{Zones: tt.zones, DNSDomainFilter: tt.filter, ZoneFallback: tt.fallback}
+			hostname, domain, err := api.SplitDNSName(tt.dnsName)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("SplitDNSName(%q) returned error %v, want error %v", tt.dnsName, err, tt.wantErr)
+			}
+			if hostname != tt.hostname || domain != tt.domain {
+				t.Errorf("SplitDNSName(%q) = %q, %q, want %q, %q", tt.dnsName, hostname, domain, tt.hostname, tt.domain)
+			}
+			if !tt.wantErr && opnsense.JoinDNSName(hostname, domain) != opnsense.JoinDNSName(tt.hostname, tt.domain) {
+				t.Errorf("JoinDNSName(%q, %q) does not restore the name", hostname, domain)
+			}
+		})
+	}
+}
+
+func TestFindZone(t *testing.T) {
+	api := &opnsense.OpnSenseApi{Zones: []string{"example.com", " lab.example.com ", "", "example.org."}}
+	tests := []struct {
+		name string
+		zone string
+	}{
+		{"www.example.com", "example.com"},
+		{"example.com", "example.com"},
+		{"www.lab.example.com", "lab.example.com"},
+		{"lab.example.com.", "lab.example.com"},
+		{"www.example.org", "example.org"},
+		{"www.example.net", ""},
+		{"notexample.com", ""},
+	}
+	for _, tt := range tests {
+		if got := api.FindZone(tt.name); got != tt.zone {
+			t.Errorf("FindZone(%q) = %q, want %q", tt.name, got, tt.zone)
+		}
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	opnsense "external-dns-opnsense/opnsense"
+)
+
+// readinessTimeout limits the requests of a readiness check, probes give up after a few seconds.
+const readinessTimeout = 5 * time.Second
+
+// readinessCheck is the outcome of a single check of /readyz.
+type readinessCheck struct {
+	Name  string `json:"name"`
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+// readinessReport is the body of /readyz.
+type readinessReport struct {
+	Ready     bool             `json:"ready"`
+	Checks    []readinessCheck `json:"checks"`
+	CheckedAt time.Time        `json:"checkedAt"`
+	LastSync  *time.Time       `json:"lastSync,omitempty"`
+	LastApply *time.Time       `json:"lastApply,omitempty"`
+}
+
+// readiness caches the checks of /readyz for ttl, so frequent probes do not hammer the firewall,
+// and tracks the last successful sync and apply of external-dns.
+type readiness struct {
+	ttl time.Duration
+
+	// checking guards the cached checks, concurrent probes wait for the same checks
+	checking  sync.Mutex
+	checkedAt time.Time
+	checks    []readinessCheck
+
+	// mu guards the sync times. It is not held during the checks, so a slow probe does not block syncs.
+	mu        sync.Mutex
+	lastSync  time.Time
+	lastApply time.Time
+}
+
+// ready holds the readiness state of the webhook.
+var ready = newReadiness(10 * time.Second)
+
+func newReadiness(ttl time.Duration) *readiness {
+	return &readiness{ttl: ttl}
+}
+
+// synced records a successful listing of the records.
+func (r *readiness) synced() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.lastSync = time.Now()
+}
+
+// applied records successfully applied changes.
+func (r *readiness) applied() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.lastApply = time.Now()
+}
+
+// report returns the readiness of the webhook, running the checks if the cached ones are outdated.
+// Concurrent probes wait for the same checks.
+func (r *readiness) report(api *opnsense.OpnSenseApi) readinessReport {
+	r.checking.Lock()
+	if r.checks == nil || time.Since(r.checkedAt) >= r.ttl {
+		r.checks = runReadinessChecks(api)
+		r.checkedAt = time.Now()
+	}
+	report := readinessReport{
+		Ready:     true,
+		Checks:    r.checks,
+		CheckedAt: r.checkedAt,
+	}
+	r.checking.Unlock()
+	for _, check := range report.Checks {
+		report.Ready = report.Ready && check.OK
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.lastSync.IsZero() {
+		lastSync := r.lastSync
+		report.LastSync = &lastSync
+	}
+	if !r.lastApply.IsZero() {
+		lastApply := r.lastApply
+		report.LastApply = &lastApply
+	}
+	return report
+}
+
+// runReadinessChecks checks that the OpnSense API accepts the credentials and that the DNS service
+// of the backend is running. Both are answered by one cheap service status request. With a
+// reconfigure scheduler, it also checks that the last scheduled reconfigure succeeded.
+func runReadinessChecks(api *opnsense.OpnSenseApi) []readinessCheck {
+	// Fail fast, the probe is repeated anyway
+	probe := *api
+	probe.ApiTimeout = min(api.ApiTimeout, readinessTimeout)
+	probe.Retry = nil
+	service := api.Backend
+
+	reachable := readinessCheck{Name: "opnsense", OK: true}
+	running := readinessCheck{Name: service, OK: true}
+	status, err := probe.ServiceStatus(service)
+	var apiErr *opnsense.APIError
+	switch {
+	case errors.As(err, &apiErr) && (apiErr.StatusCode == http.StatusUnauthorized || apiErr.StatusCode == http.StatusForbidden):
+		reachable.OK = false
+		reachable.Error = fmt.Sprintf("authentication failed with status %d, check OPNSENSE_API_KEY, OPNSENSE_API_SECRET and the privileges of the key", apiErr.StatusCode)
+	case err != nil:
+		reachable.OK = false
+		reachable.Error = err.Error()
+	case status != "running":
+		running.OK = false
+		running.Error = fmt.Sprintf("service is %s", status)
+	}
+	if !reachable.OK {
+		running.OK = false
+		running.Error = "not checked, the OpnSense API is not available"
+	}
+	checks := []readinessCheck{reachable, running}
+	if api.Scheduler != nil {
+		reconfigure := readinessCheck{Name: "reconfigure", OK: true}
+		if err := api.Scheduler.Err(); err != nil {
+			reconfigure.OK = false
+			reconfigure.Error = fmt.Sprintf("the last reconfigure of %s failed and is retried, saved changes are not active: %v", api.Scheduler.Service(), err)
+		}
+		checks = append(checks, reconfigure)
+	}
+	for _, check := range checks {
+		if !check.OK {
+			log.Printf("Readiness: Check %s failed: %s", check.Name, check.Error)
+		}
+	}
+	return checks
+}
+
+// readyzHandler handles readiness probes. It answers 200 if the webhook can manage records and 503 otherwise,
+// with a JSON body explaining the checks. Unlike healthzHandler, it depends on the firewall.
+func readyzHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Only GET allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	report := ready.report(api)
+	w.Header().Set("Content-Type", "application/json")
+	if report.Ready {
+		w.WriteHeader(http.StatusOK)
+	} else {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(report)
+}
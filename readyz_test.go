@@ -0,0 +1,189 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	opnsense "external-dns-opnsense/opnsense"
+	"external-dns-opnsense/opnsense/opnsensetest"
+)
+
+// serveReadyz sends a readiness probe to the health listener and decodes its report.
+func serveReadyz(t *testing.T) (int, readinessReport) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	healthHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	var report readinessReport
+	if err := json.NewDecoder(rec.Body).Decode(&report); err != nil {
+		t.Fatalf("decoding the report: %v", err)
+	}
+	return rec.Code, report
+}
+
+// useReadiness replaces the readiness state for the test.
+func useReadiness(t *testing.T, ttl time.Duration) {
+	t.Helper()
+	previous := ready
+	ready = newReadiness(ttl)
+	t.Cleanup(func() { ready = previous })
+}
+
+// failedCheck returns the first failed check of report.
+func failedCheck(report readinessReport) *readinessCheck {
+	for _, check := range report.Checks {
+		if !check.OK {
+			return &check
+		}
+	}
+	return nil
+}
+
+func TestReadyz(t *testing.T) {
+	tests := []struct {
+		name   string
+		setup  func(srv *opnsensetest.Server)
+		failed string
+		reason string
+	}{
+		{"ready", func(srv *opnsensetest.Server) {}, "", ""},
+		{"wrong credentials", func(srv *opnsensetest.Server) { api.APISecret = "wrong" }, "opnsense", "authentication failed with status 401"},
+		{"forbidden", func(srv *opnsensetest.Server) {
+			srv.Inject(opnsensetest.Fault{Path: "service/status", Status: http.StatusForbidden})
+		}, "opnsense", "authentication failed with status 403"},
+		{"unreachable", func(srv *opnsensetest.Server) { srv.Close() }, "opnsense", "connect"},
+		{"service stopped", func(srv *opnsensetest.Server) { srv.SetServiceStatus("unbound", "stopped") }, "unbound", "service is stopped"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := newTestServer(t, opnsense.BackendUnbound)
+			useReadiness(t, time.Minute)
+			tt.setup(srv)
+
+			code, report := serveReadyz(t)
+			failed := failedCheck(report)
+			if tt.failed == "" {
+				if code != http.StatusOK || !report.Ready || failed != nil {
+					t.Errorf("GET /readyz returned %d with %+v, want ready", code, report)
+				}
+				return
+			}
+			if code != http.StatusServiceUnavailable || report.Ready {
+				t.Errorf("GET /readyz returned %d with ready %v, want not ready", code, report.Ready)
+			}
+			if failed == nil || failed.Name != tt.failed || !strings.Contains(failed.Error, tt.reason) {
+				t.Errorf("failed check is %+v, want %s failing with %q", failed, tt.failed, tt.reason)
+			}
+		})
+	}
+}
+
+func TestReadyzCached(t *testing.T) {
+	srv := newTestServer(t, opnsense.BackendUnbound)
+	useReadiness(t, time.Minute)
+
+	for range 3 {
+		if code, _ := serveReadyz(t); code != http.StatusOK {
+			t.Fatalf("GET /readyz returned %d", code)
+		}
+	}
+	if got := countStatusCalls(srv); got != 1 {
+		t.Errorf("checked the service %d times, want 1", got)
+	}
+
+	// A stopped service shows once the cached checks are outdated
+	srv.SetServiceStatus("unbound", "stopped")
+	useReadiness(t, 0)
+	if code, _ := serveReadyz(t); code != http.StatusServiceUnavailable {
+		t.Errorf("GET /readyz returned %d after the service stopped", code)
+	}
+}
+
+func TestReadyzLastSync(t *testing.T) {
+	newTestServer(t, opnsense.BackendUnbound)
+	useReadiness(t, time.Minute)
+
+	if _, report := serveReadyz(t); report.LastSync != nil || report.LastApply != nil {
+		t.Errorf("report %+v has sync times before any sync", report)
+	}
+	before := time.Now()
+	if rec := serveRecords(t, http.MethodGet, nil); rec.Code != http.StatusOK {
+		t.Fatalf("GET /records returned %d", rec.Code)
+	}
+	_, report := serveReadyz(t)
+	if report.LastSync == nil || report.LastSync.Before(before) {
+		t.Errorf("last sync is %v, want after %v", report.LastSync, before)
+	}
+	if report.LastApply != nil {
+		t.Errorf("last apply is %v without any apply", report.LastApply)
+	}
+}
+
+func TestReadyzSlowProbe(t *testing.T) {
+	srv := newTestServer(t, opnsense.BackendUnbound)
+	useReadiness(t, 0)
+	srv.Inject(opnsensetest.Fault{Path: "service/status", Latency: time.Second})
+
+	probed := make(chan struct{})
+	go func() {
+		defer close(probed)
+		healthHandler().ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	}()
+	// Wait for the probe to run its checks
+	opnsensetest.WaitUntil(t, func() bool {
+		if ready.checking.TryLock() {
+			ready.checking.Unlock()
+			return false
+		}
+		return true
+	})
+
+	// A sync must not wait for the firewall to answer the probe
+	start := time.Now()
+	if rec := serveRecords(t, http.MethodGet, nil); rec.Code != http.StatusOK {
+		t.Errorf("GET /records returned %d", rec.Code)
+	}
+	if elapsed := time.Since(start); elapsed >= 500*time.Millisecond {
+		t.Errorf("GET /records took %s during a slow readiness probe", elapsed)
+	}
+	<-probed
+}
+
+// countStatusCalls returns the number of service status requests to srv.
+func countStatusCalls(srv *opnsensetest.Server) int {
+	n := 0
+	for _, call := range srv.Calls() {
+		if strings.Contains(call.Path, "service/status") {
+			n++
+		}
+	}
+	return n
+}
+
+func TestReadyzReconfigureFailed(t *testing.T) {
+	srv := newTestServer(t, opnsense.BackendUnbound)
+	useReadiness(t, 0)
+	api.ReconfigureRetries = 0
+	api.Scheduler = opnsense.NewReconfigureScheduler(api, "unbound", 10*time.Millisecond, time.Second, true)
+	srv.Inject(opnsensetest.Fault{Path: "reconfigure", Status: http.StatusInternalServerError})
+
+	// An async reconfigure fails in the background, only readiness tells
+	if err := api.Scheduler.Request(); err != nil {
+		t.Fatal(err)
+	}
+	opnsensetest.WaitUntil(t, func() bool { return api.Scheduler.Err() != nil })
+	code, report := serveReadyz(t)
+	if failed := failedCheck(report); code != http.StatusServiceUnavailable || failed == nil || failed.Name != "reconfigure" {
+		t.Errorf("GET /readyz returned %d with %+v, want the reconfigure check failing", code, report)
+	}
+
+	// The reconfigure is retried until it succeeds
+	srv.ClearFaults()
+	opnsensetest.WaitUntil(t, func() bool { return api.Scheduler.Err() == nil })
+	if code, report := serveReadyz(t); code != http.StatusOK {
+		t.Errorf("GET /readyz returned %d with %+v after the reconfigure succeeded", code, report)
+	}
+}
@@ -3,11 +3,10 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
-	"strconv"
-	"strings"
 
 	opnsense "external-dns-opnsense/opnsense"
 
@@ -28,12 +27,13 @@ func recordsHandler(w http.ResponseWriter, r *http.Request) {
 		// Create a new context for this request
 		ctx, cancel := context.WithTimeout(context.Background(), api.ApiTimeout)
 		defer cancel()
-		// Apply the changes using the new context
-		errs := ApplyChanges(api.WithContext(ctx), changes)
+		// Apply the changes using the new context as one batch
+		errs := ApplyChanges(NewBackend(api.WithBatch().WithContext(ctx)), changes)
 		if len(errs) > 0 {
-			http.Error(w, "Error applying changes", http.StatusInternalServerError)
+			http.Error(w, "Error applying changes:\n"+errors.Join(errs...).Error(), http.StatusInternalServerError)
 			return
 		}
+		ready.applied()
 		w.WriteHeader(http.StatusNoContent)
 
 	case http.MethodGet:
@@ -41,7 +41,12 @@ func recordsHandler(w http.ResponseWriter, r *http.Request) {
 		ctx, cancel := context.WithTimeout(context.Background(), api.ApiTimeout)
 		defer cancel()
 		// Retrieve the list of DNS records using the new context
-		records := ReadEntries(api.WithContext(ctx), api.OwnerID)
+		records, err := ReadEntries(api, NewBackend(api.WithBatch().WithContext(ctx)))
+		if err != nil {
+			http.Error(w, "Error retrieving records:\n"+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		ready.synced()
 
 		// Set the response content type to JSON and encode the records into the response
 		w.Header().Set("Content-Type", "application/external.dns.webhook+json;version=1")
@@ -51,218 +56,129 @@ func recordsHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func ApplyChanges(api *opnsense.OpnSenseApi, changes plan.Changes) []error {
-	var errors []error
+// ApplyChanges applies the changes of a plan through the backend and commits them.
+// All errors are collected, a failing record does not stop the others from being applied.
+// Updates that do not change what is stored are skipped; the backend skips the commit if nothing was written.
+func ApplyChanges(backend Backend, changes plan.Changes) []error {
+	var errs []error
 	for _, delete := range changes.Delete {
-		if err := DeleteEntry(api, delete); err != nil {
+		if err := checkReadOnly(delete); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		err := backend.Delete(delete)
+		observeChange("delete", delete, err)
+		if err != nil {
 			log.Printf("Error deleting entry %v: %v", delete, err)
-			errors = append(errors, err)
+			errs = append(errs, err)
 		}
 	}
 	for _, create := range changes.Create {
-		if err := CreateEntry(api, create); err != nil {
+		err := backend.Create(create)
+		observeChange("create", create, err)
+		if err != nil {
 			log.Printf("Error creating entry %v: %v", create, err)
-			errors = append(errors, err)
+			errs = append(errs, err)
 		}
 	}
-	for _, update := range changes.UpdateNew {
-		if err := UpdateEntry(api, update); err != nil {
-			log.Printf("Error updating entry %v: %v", update, err)
-			errors = append(errors, err)
+	for _, update := range updatePairs(changes) {
+		if err := checkReadOnly(update.old); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if update.unchanged() {
+			log.Printf("Skipping update of unchanged entry %v", update.desired)
+			continue
+		}
+		err := backend.Update(update.old, update.desired)
+		observeChange("update", update.desired, err)
+		if err != nil {
+			log.Printf("Error updating entry %v: %v", update.desired, err)
+			errs = append(errs, err)
 		}
 	}
-	if err := api.ApplyChanges(); err != nil {
+	if err := backend.Commit(); err != nil {
 		log.Printf("Error applying changes to OPNsense: %v", err)
-		errors = append(errors, err)
+		errs = append(errs, err)
 	}
-	return errors
+	return errs
 }
 
-func ReadEntries(api *opnsense.OpnSenseApi, searchString string) []*endpoint.Endpoint {
-	ctx, cancel := context.WithTimeout(context.Background(), api.ApiTimeout)
-	defer cancel()
-	overrides, err := opnsense.SearchHostOverrides(api.WithContext(ctx), searchString)
+// readOnlyLabel marks endpoints of records not owned by this instance. They are only listed if
+// IncludeUnowned is set, so external-dns sees the names as taken, and are never written.
+const readOnlyLabel = "readonly"
+
+// ReadEntries returns the records of the backend owned by this instance, and with IncludeUnowned all
+// other records as read-only endpoints. Ownership is matched exactly against the owner label.
+func ReadEntries(api *opnsense.OpnSenseApi, backend Backend) ([]*endpoint.Endpoint, error) {
+	records, err := backend.List()
 	if err != nil {
-		log.Printf("List: Error retrieving host overrides: %v\n", err)
-		return []*endpoint.Endpoint{}
+		log.Printf("List: Error retrieving records: %v\n", err)
+		return nil, err
 	}
 	endpoints := []*endpoint.Endpoint{}
-	for _, r := range overrides {
-		ttl := int64(0)
-		targets := []string{}
-		if r.TTL != "" {
-			ttl, err = strconv.ParseInt(r.TTL, 10, 64)
-			if err != nil {
-				// Do not drop the record on TTL parse error; log and use 0 as TTL
-				log.Printf("Error converting TTL to int for %s.%s: %v. Using TTL=0", r.HostName, r.Domain, err)
-				ttl = 0
+	for _, ep := range records {
+		if ep.Labels[endpoint.OwnerLabelKey] != api.OwnerID {
+			if !api.IncludeUnowned {
+				continue
 			}
+			ep.Labels[readOnlyLabel] = "true"
 		}
-		switch r.Type {
-		case "A":
-			targets = append(targets, r.Server)
-		case "AAAA":
-			targets = append(targets, r.Server)
-		case "TXT":
-			targets = append(targets, r.TxtData)
-		default:
-		}
-
-		endpoint := endpoint.Endpoint{
-			DNSName:    r.HostName + "." + r.Domain,
-			RecordType: r.Type,
-			Targets:    targets,
-			RecordTTL:  endpoint.TTL(ttl),
-			Labels: map[string]string{
-				"owner": r.Description,
-				"uuid":  r.Uuid,
-			},
-		}
-		endpoints = append(endpoints, &endpoint)
+		endpoints = append(endpoints, ep)
 	}
+	observeManaged(api, endpoints)
 	log.Printf("List: Retrieved %d records\n", len(endpoints))
-	return endpoints
+	return endpoints, nil
 }
 
-func CreateEntry(api *opnsense.OpnSenseApi, ep *endpoint.Endpoint) error {
-	log.Printf("Creating entry: %s %s %v\n", ep.DNSName, ep.RecordType, ep.Targets)
-	parts := strings.Split(ep.DNSName, ".")
-	if len(parts) < 2 {
-		log.Printf("Invalid DNSName: %s", ep.DNSName)
-		return fmt.Errorf("invalid DNSName: %s", ep.DNSName)
+// descriptionLabels returns the endpoint labels parsed from the description of a record.
+func descriptionLabels(description string) map[string]string {
+	ownership := opnsense.ParseDescription(description)
+	labels := map[string]string{
+		endpoint.OwnerLabelKey: ownership.Owner,
 	}
-	hostname := parts[0]
-	domain := strings.Join(parts[1:], ".")
-	override := opnsense.OpnSenseHostOverride{
-		HostName:    hostname,
-		Domain:      domain,
-		Type:        ep.RecordType,
-		TTL:         strconv.FormatInt(int64(ep.RecordTTL), 10),
-		Enabled:     "1",
-		Description: api.OwnerID,
+	if ownership.Resource != "" {
+		labels[endpoint.ResourceLabelKey] = ownership.Resource
 	}
+	return labels
+}
 
-	for _, target := range ep.Targets {
-		switch ep.RecordType {
-		case endpoint.RecordTypeA:
-			override.Server = target
-		case endpoint.RecordTypeAAAA:
-			override.Server = target
-		case endpoint.RecordTypePTR:
-			override.Server = target
-		case endpoint.RecordTypeTXT:
-			override.TxtData = target
-		default:
-			log.Printf("Record %s is not supported", ep.RecordType)
-		}
-		ctx, cancel := context.WithTimeout(context.Background(), api.ApiTimeout)
-		defer cancel()
-		log.Printf("CreateEntry: Creating host override: %+v\n", override)
-		err := override.Create(api.WithContext(ctx))
-		if err != nil {
-			log.Printf("CreateEntry: Error creating host override: %v\n", err)
-			return err
-		}
+// checkReadOnly refuses changes to endpoints that were listed read-only.
+func checkReadOnly(ep *endpoint.Endpoint) error {
+	if ep != nil && ep.Labels[readOnlyLabel] == "true" {
+		return fmt.Errorf("%w: %s is read-only", opnsense.ErrOwnershipConflict, ep.DNSName)
 	}
-
 	return nil
 }
 
-func UpdateEntry(api *opnsense.OpnSenseApi, ep *endpoint.Endpoint) error {
-	log.Printf("Updating entry: %s %s %v\n", ep.DNSName, ep.RecordType, ep.Targets)
-	parts := strings.Split(ep.DNSName, ".")
-	if len(parts) < 2 {
-		log.Printf("Invalid DNSName: %s", ep.DNSName)
-		return fmt.Errorf("invalid DNSName: %s", ep.DNSName)
-	}
-	hostname := parts[0]
-	domain := strings.Join(parts[1:], ".")
-	override := opnsense.OpnSenseHostOverride{
-		Uuid: ep.Labels["uuid"],
-		HostName: hostname,
-		Domain: domain,
-	}
-	err := override.Read(api)
-	if err != nil {
-		log.Printf("UpdateEntry: Error finding existing override with id %s: %v\n", ep.Labels["uuid"], err)
-		return err
-	}
-
-	ctx, cancel := context.WithTimeout(context.Background(), api.ApiTimeout)
-	defer cancel()
-	log.Printf("UpdateEntry: Updating host override: %+v\n", override)
-	err = override.Update(api.WithContext(ctx))
-	if err != nil {
-		log.Printf("UpdateEntry: Error updating host override: %v\n", err)
-		return err
-	}
-
-	return nil
+// updatePair is an endpoint of plan.Changes.UpdateNew together with its counterpart from UpdateOld.
+type updatePair struct {
+	old     *endpoint.Endpoint
+	desired *endpoint.Endpoint
 }
 
-func DeleteEntry(api *opnsense.OpnSenseApi, ep *endpoint.Endpoint) error {
-	log.Printf("Deleting entry: %s %s %v %v\n", ep.DNSName, ep.RecordType, ep.Targets, ep.Labels)
-	parts := strings.Split(ep.DNSName, ".")
-	if len(parts) < 2 {
-		log.Printf("Invalid DNSName: %s", ep.DNSName)
-		return fmt.Errorf("invalid DNSName: %s", ep.DNSName)
-	}
-	hostname := parts[0]
-	domain := strings.Join(parts[1:], ".")
-	override := opnsense.OpnSenseHostOverride{
-		Uuid: ep.Labels["uuid"],
-		HostName: hostname,
-		Domain: domain,
-	}
-	err := override.Read(api)
-	if err != nil {
-		log.Printf("DeleteEntry: Error finding existing override with id %s: %v\n", ep.Labels["uuid"], err)
-		return err
-	}
+// unchanged reports whether the update keeps everything the backends store: the targets, the TTL and the resource.
+// Other differences, like provider specific properties, are not stored and need no write.
+func (u updatePair) unchanged() bool {
+	return u.old != nil &&
+		u.old.Targets.Same(u.desired.Targets) &&
+		u.old.RecordTTL == u.desired.RecordTTL &&
+		u.old.Labels[endpoint.ResourceLabelKey] == u.desired.Labels[endpoint.ResourceLabelKey]
+}
 
-	if hostname != override.HostName {
-		return fmt.Errorf("DeleteEntry: Hostname does not match with expected Value. Hostname: %s, Expected: %s", override.HostName, hostname)
+// updatePairs matches every UpdateNew endpoint with the UpdateOld endpoint of the same name, record type and set identifier.
+// old is nil if external-dns did not send a counterpart.
+func updatePairs(changes plan.Changes) []updatePair {
+	key := func(ep *endpoint.Endpoint) string {
+		return ep.DNSName + "/" + ep.RecordType + "/" + ep.SetIdentifier
 	}
-	if domain != override.Domain {
-		return fmt.Errorf("DeleteEntry: Domain does not match with expected Value. Domain: %s, Expected: %s", override.Domain, domain)
+	olds := map[string]*endpoint.Endpoint{}
+	for _, old := range changes.UpdateOld {
+		olds[key(old)] = old
 	}
-
-	ctx, cancel := context.WithTimeout(context.Background(), api.ApiTimeout)
-	defer cancel()
-	log.Printf("DeleteEntry: Deleting host override: %+v\n", override)
-	err = override.Delete(api.WithContext(ctx))
-	if err != nil {
-		log.Printf("DeleteEntry: Error deleting host override: %v\n", err)
-		return err
+	pairs := make([]updatePair, 0, len(changes.UpdateNew))
+	for _, desired := range changes.UpdateNew {
+		pairs = append(pairs, updatePair{old: olds[key(desired)], desired: desired})
 	}
-
-	return nil
+	return pairs
 }
-
-// func FindOverrides(api *opnsense.OpnSenseApi, DNSName string, RecordType string) ([]*opnsense.OpnSenseHostOverride, error) {
-// 	searchString := strings.Join(strings.Split(DNSName, "."), " ") + " " + api.OwnerID + " " + string(RecordType)
-// 	log.Printf("FindOverrideUUID: searching for overrides matching endpoint %s with search string '%s'", DNSName, searchString)
-// 	ctx, cancel := context.WithTimeout(context.Background(), api.ApiTimeout)
-// 	defer cancel()
-// 	overrides, err := opnsense.SearchHostOverrides(api.WithContext(ctx), searchString)
-// 	if err != nil {
-// 		return nil, fmt.Errorf("FindOverrideUUID: error searching host overrides for %s: %v", DNSName, err)
-// 	}
-// 	if len(overrides) == 0 {
-// 		log.Printf("FindOverrideUUID: no overrides found matching endpoint %s", DNSName)
-// 		return nil, fmt.Errorf("FindOverrideUUID: no overrides found matching endpoint %s", DNSName)
-// 	}
-// 	var overridesToReturn []*opnsense.OpnSenseHostOverride
-// 	for _, o := range overrides {
-// 		if o.HostName+"."+o.Domain != DNSName {
-// 			continue
-// 		}
-// 		if o.Type != string(RecordType) {
-// 			continue
-// 		}
-// 		// Match found
-// 		log.Printf("FindOverrideUUID: found matching override with UUID %s for [%s] %s", o.Uuid, RecordType, DNSName)
-// 		overridesToReturn = append(overridesToReturn, o)
-// 	}
-// 	return overridesToReturn, nil
-// }
@@ -0,0 +1,365 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	opnsense "external-dns-opnsense/opnsense"
+	"external-dns-opnsense/opnsense/opnsensetest"
+
+	"sigs.k8s.io/external-dns/endpoint"
+	"sigs.k8s.io/external-dns/plan"
+)
+
+// newTestServer starts a fake OpnSense API and points the webhook at it, managing the records of backend.
+func newTestServer(t *testing.T, backend string) *opnsensetest.Server {
+	t.Helper()
+	srv := opnsensetest.NewServer()
+	t.Cleanup(srv.Close)
+	previous := api
+	api = srv.Api()
+	api.Backend = backend
+	t.Cleanup(func() { api = previous })
+	return srv
+}
+
+// serveRecords sends a request to recordsHandler and returns the recorded response.
+func serveRecords(t *testing.T, method string, changes *plan.Changes) *httptest.ResponseRecorder {
+	t.Helper()
+	var body bytes.Buffer
+	if changes != nil {
+		if err := json.NewEncoder(&body).Encode(changes); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rec := httptest.NewRecorder()
+	recordsHandler(rec, httptest.NewRequest(method, "/records", &body))
+	return rec
+}
+
+// overrideTargets returns the stored host overrides as sorted "name type target" strings.
+func overrideTargets(srv *opnsensetest.Server) []string {
+	targets := []string{}
+	for _, o := range srv.HostOverrides() {
+		targets = append(targets, opnsense.JoinDNSName(o.HostName, o.Domain)+" "+o.Type+" "+o.Target())
+	}
+	slices.Sort(targets)
+	return targets
+}
+
+func TestRecordsGetFaults(t *testing.T) {
+	tests := []struct {
+		name  string
+		fault opnsensetest.Fault
+	}{
+		{"unauthorized", opnsensetest.Fault{Path: "search_host_override", Status: http.StatusUnauthorized}},
+		{"forbidden", opnsensetest.Fault{Path: "search_host_override", Status: http.StatusForbidden}},
+		{"server error", opnsensetest.Fault{Path: "search_host_alias", Status: http.StatusBadGateway}},
+		{"truncated JSON", opnsensetest.Fault{Path: "search_host_override", TruncateJSON: true}},
+		{"latency beyond timeout", opnsensetest.Fault{Path: "search_host_override", Latency: time.Second}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := newTestServer(t, opnsense.BackendUnbound)
+			api.ApiTimeout = 200 * time.Millisecond
+			srv.AddHostOverride(opnsense.OpnSenseHostOverride{
+				Enabled:     "1",
+				HostName:    "www",
+				Domain:      "example.com",
+				Type:        "A",
+				Server:      "192.0.2.1",
+				Description: api.Description("", "A"),
+			})
+			srv.Inject(tt.fault)
+
+			rec := serveRecords(t, http.MethodGet, nil)
+			if rec.Code != http.StatusInternalServerError {
+				t.Fatalf("GET /records returned %d, want %d", rec.Code, http.StatusInternalServerError)
+			}
+		})
+	}
+}
+
+func TestRecordsPostFaults(t *testing.T) {
+	www := endpoint.NewEndpoint("www.example.com", endpoint.RecordTypeA, "192.0.2.1")
+	mail := endpoint.NewEndpoint("mail.example.com", endpoint.RecordTypeA, "192.0.2.2")
+	changes := &plan.Changes{Create: []*endpoint.Endpoint{www, mail}}
+
+	tests := []struct {
+		name    string
+		fault   opnsensetest.Fault
+		wantErr error
+		// stored are the records on the server after the failed apply
+		stored []string
+		// reconfigures counts the successful reconfigures of the failed apply
+		reconfigures int
+	}{
+		{
+			name:         "server error on add",
+			fault:        opnsensetest.Fault{Path: "add_host_override", Times: 1, Status: http.StatusInternalServerError},
+			wantErr:      opnsense.ErrFailedToCreate,
+			stored:       []string{"mail.example.com A 192.0.2.2"},
+			reconfigures: 1,
+		},
+		{
+			name:         "unauthorized on search",
+			fault:        opnsensetest.Fault{Path: "search_host_override", Times: 1, Status: http.StatusUnauthorized},
+			wantErr:      opnsense.ErrFailedToRead,
+			stored:       []string{"mail.example.com A 192.0.2.2"},
+			reconfigures: 1,
+		},
+		{
+			name:         "validation failure",
+			fault:        opnsensetest.Fault{Path: "add_host_override", Times: 1, Validations: map[string]string{"host.hostname": "A valid hostname is required."}},
+			wantErr:      opnsense.ErrApiReturnedError,
+			stored:       []string{"mail.example.com A 192.0.2.2"},
+			reconfigures: 1,
+		},
+		{
+			// The write landed, only the answer got lost
+			name:         "truncated answer to add",
+			fault:        opnsensetest.Fault{Path: "add_host_override", Times: 1, TruncateJSON: true},
+			stored:       []string{"mail.example.com A 192.0.2.2", "www.example.com A 192.0.2.1"},
+			reconfigures: 1,
+		},
+		{
+			name:    "reconfigure error status",
+			fault:   opnsensetest.Fault{Path: "reconfigure", Times: 1, Status: http.StatusBadGateway},
+			wantErr: opnsense.ErrFailedToApply,
+			stored:  []string{"mail.example.com A 192.0.2.2", "www.example.com A 192.0.2.1"},
+		},
+		{
+			name:    "reconfigure failed",
+			fault:   opnsensetest.Fault{Path: "reconfigure", Times: 1, ReconfigureStatus: "failed"},
+			wantErr: opnsense.ErrFailedToApply,
+			stored:  []string{"mail.example.com A 192.0.2.2", "www.example.com A 192.0.2.1"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := newTestServer(t, opnsense.BackendUnbound)
+			srv.Inject(tt.fault)
+
+			errs := ApplyChanges(NewBackend(api), *changes)
+			if len(errs) == 0 {
+				t.Fatal("ApplyChanges succeeded despite the fault")
+			}
+			if tt.wantErr != nil && !errors.Is(errors.Join(errs...), tt.wantErr) {
+				t.Errorf("ApplyChanges returned %v, want %v", errs, tt.wantErr)
+			}
+			if got := overrideTargets(srv); strings.Join(got, ",") != strings.Join(tt.stored, ",") {
+				t.Errorf("stored overrides %v, want %v", got, tt.stored)
+			}
+			// The records that were written must still be activated
+			if got := srv.Reconfigures("unbound"); got != tt.reconfigures {
+				t.Errorf("unbound reconfigured %d times, want %d", got, tt.reconfigures)
+			}
+
+			// external-dns replays the plan in its next sync, which must converge without duplicates
+			if rec := serveRecords(t, http.MethodPost, changes); rec.Code != http.StatusNoContent {
+				t.Fatalf("replayed POST /records returned %d: %s", rec.Code, rec.Body)
+			}
+			want := []string{"mail.example.com A 192.0.2.2", "www.example.com A 192.0.2.1"}
+			if got := overrideTargets(srv); strings.Join(got, ",") != strings.Join(want, ",") {
+				t.Errorf("stored overrides after replay %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestRecordsPostReportsFailure(t *testing.T) {
+	srv := newTestServer(t, opnsense.BackendUnbound)
+	srv.Inject(opnsensetest.Fault{Path: "add_host_override", Validations: map[string]string{"host.server": "A valid IP address must be specified."}})
+
+	changes := &plan.Changes{Create: []*endpoint.Endpoint{endpoint.NewEndpoint("www.example.com", endpoint.RecordTypeA, "192.0.2.1")}}
+	rec := serveRecords(t, http.MethodPost, changes)
+	if rec.Code != http.StatusInternalServerError {
+		t.Fatalf("POST /records returned %d, want %d", rec.Code, http.StatusInternalServerError)
+	}
+	if !strings.Contains(rec.Body.String(), "host.server: A valid IP address must be specified.") {
+		t.Errorf("POST /records answered %q, want the validation message", rec.Body)
+	}
+
+	errs := ApplyChanges(NewBackend(api), *changes)
+	if len(errs) != 1 {
+		t.Fatalf("ApplyChanges returned %v, want one error", errs)
+	}
+	var apiErr *opnsense.APIError
+	if !errors.As(errs[0], &apiErr) {
+		t.Fatalf("ApplyChanges returned %v, want an APIError", errs[0])
+	}
+	if apiErr.Method != http.MethodPost || apiErr.Path != "/api/unbound/settings/add_host_override" || apiErr.StatusCode != http.StatusOK ||
+		apiErr.Result != "failed" || apiErr.Validations["host.server"] != "A valid IP address must be specified." {
+		t.Errorf("APIError is %+v", apiErr)
+	}
+	if !errors.Is(errs[0], opnsense.ErrFailedToCreate) || !errors.Is(errs[0], opnsense.ErrApiReturnedError) {
+		t.Errorf("%v does not match its sentinels", errs[0])
+	}
+}
+
+func TestRecordsDeleteFault(t *testing.T) {
+	srv := newTestServer(t, opnsense.BackendUnbound)
+	for _, name := range []string{"www", "mail"} {
+		srv.AddHostOverride(opnsense.OpnSenseHostOverride{
+			Enabled:     "1",
+			HostName:    name,
+			Domain:      "example.com",
+			Type:        "A",
+			Server:      "192.0.2.1",
+			Description: api.Description("", "A"),
+		})
+	}
+	records, err := ReadEntries(api, NewBackend(api))
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.Inject(opnsensetest.Fault{Path: "del_host_override", Times: 1, Status: http.StatusServiceUnavailable})
+
+	errs := ApplyChanges(NewBackend(api), plan.Changes{Delete: records})
+	if len(errs) != 1 || !errors.Is(errs[0], opnsense.ErrFailedToDelete) {
+		t.Fatalf("ApplyChanges returned %v, want %v", errs, opnsense.ErrFailedToDelete)
+	}
+	if got := srv.HostOverrides(); len(got) != 1 {
+		t.Fatalf("%d overrides left after a failed delete, want 1", len(got))
+	}
+
+	// The record that could not be deleted is still listed, so external-dns deletes it again
+	records, err = ReadEntries(api, NewBackend(api))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if errs := ApplyChanges(NewBackend(api), plan.Changes{Delete: records}); len(errs) != 0 {
+		t.Fatalf("replayed delete returned %v", errs)
+	}
+	if got := srv.HostOverrides(); len(got) != 0 {
+		t.Errorf("%d overrides left, want none", len(got))
+	}
+}
+
+func TestRecordsPostSkipsNoOp(t *testing.T) {
+	srv := newTestServer(t, opnsense.BackendUnbound)
+	www := endpoint.NewEndpoint("www.example.com", endpoint.RecordTypeA, "192.0.2.1")
+	if rec := serveRecords(t, http.MethodPost, &plan.Changes{Create: []*endpoint.Endpoint{www}}); rec.Code != http.StatusNoContent {
+		t.Fatalf("POST /records returned %d: %s", rec.Code, rec.Body)
+	}
+	records, err := ReadEntries(api, NewBackend(api))
+	if err != nil || len(records) != 1 {
+		t.Fatalf("ReadEntries returned %v, %v", records, err)
+	}
+	changed := records[0].DeepCopy()
+	changed.ProviderSpecific = endpoint.ProviderSpecific{{Name: "alias", Value: "false"}}
+
+	tests := []struct {
+		name    string
+		changes *plan.Changes
+	}{
+		{"empty plan", &plan.Changes{}},
+		{"unchanged update", &plan.Changes{UpdateOld: records, UpdateNew: []*endpoint.Endpoint{changed}}},
+		{"create of an existing record", &plan.Changes{Create: []*endpoint.Endpoint{www}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reconfigures := srv.Reconfigures("unbound")
+			skipped := opnsense.SkippedReconfigures()
+			calls := len(srv.Calls())
+
+			if rec := serveRecords(t, http.MethodPost, tt.changes); rec.Code != http.StatusNoContent {
+				t.Fatalf("POST /records returned %d: %s", rec.Code, rec.Body)
+			}
+			for _, call := range srv.Calls()[calls:] {
+				if !strings.Contains(call.Path, "search") {
+					t.Errorf("unexpected request %s %s", call.Method, call.Path)
+				}
+			}
+			if got := srv.Reconfigures("unbound"); got != reconfigures {
+				t.Errorf("unbound reconfigured %d times, want none", got-reconfigures)
+			}
+			if got := opnsense.SkippedReconfigures(); got != skipped+1 {
+				t.Errorf("%d reconfigures skipped, want 1", got-skipped)
+			}
+		})
+	}
+}
+
+func TestRecordsCNAMEWithoutTarget(t *testing.T) {
+	srv := newTestServer(t, opnsense.BackendUnbound)
+	cname := endpoint.NewEndpoint("web.example.com", endpoint.RecordTypeCNAME, "www.example.com")
+
+	// Unbound can only alias host overrides, the target is not looked up in DNS instead
+	errs := ApplyChanges(NewBackend(api), plan.Changes{Create: []*endpoint.Endpoint{cname}})
+	if len(errs) != 1 || !errors.Is(errs[0], opnsense.ErrAliasTargetNotFound) {
+		t.Fatalf("ApplyChanges returned %v, want %v", errs, opnsense.ErrAliasTargetNotFound)
+	}
+	if got := overrideTargets(srv); len(got) != 0 {
+		t.Errorf("overrides %v created for the alias target", got)
+	}
+
+	// Once external-dns created the target, the next sync creates the alias
+	www := endpoint.NewEndpoint("www.example.com", endpoint.RecordTypeA, "192.0.2.1")
+	if errs := ApplyChanges(NewBackend(api), plan.Changes{Create: []*endpoint.Endpoint{www, cname}}); len(errs) != 0 {
+		t.Fatalf("ApplyChanges returned %v", errs)
+	}
+	if got := srv.HostAliases(); len(got) != 1 {
+		t.Errorf("%d aliases created, want 1", len(got))
+	}
+}
+
+func TestRecordsCreateNextToUnowned(t *testing.T) {
+	tests := []struct {
+		policy  string
+		wantErr bool
+	}{
+		{opnsense.ConflictRefuse, true},
+		{opnsense.ConflictAdoptUnowned, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.policy, func(t *testing.T) {
+			srv := newTestServer(t, opnsense.BackendUnbound)
+			api.ConflictPolicy = tt.policy
+			srv.AddHostOverride(opnsense.OpnSenseHostOverride{Enabled: "1", HostName: "www", Domain: "example.com", Type: "A", Server: "192.0.2.1"})
+
+			// A new target would turn the name of the admin into a round-robin
+			www := endpoint.NewEndpoint("www.example.com", endpoint.RecordTypeA, "192.0.2.2")
+			errs := ApplyChanges(NewBackend(api), plan.Changes{Create: []*endpoint.Endpoint{www}})
+			if tt.wantErr != (len(errs) > 0) {
+				t.Fatalf("ApplyChanges returned %v, want error %v", errs, tt.wantErr)
+			}
+			if tt.wantErr {
+				if !errors.Is(errs[0], opnsense.ErrOwnershipConflict) {
+					t.Errorf("ApplyChanges returned %v, want %v", errs, opnsense.ErrOwnershipConflict)
+				}
+				if got := overrideTargets(srv); len(got) != 1 {
+					t.Errorf("stored overrides %v, want only the unowned one", got)
+				}
+			}
+		})
+	}
+}
+
+func TestRecordsPostSlowWrites(t *testing.T) {
+	srv := newTestServer(t, opnsense.BackendUnbound)
+	api.ApiTimeout = 300 * time.Millisecond
+	srv.Inject(opnsensetest.Fault{Path: "add_host_override", Latency: 200 * time.Millisecond})
+
+	// The writes take longer than the timeout of the request, the reconfigure must still activate them
+	changes := &plan.Changes{Create: []*endpoint.Endpoint{
+		endpoint.NewEndpoint("www.example.com", endpoint.RecordTypeA, "192.0.2.1"),
+		endpoint.NewEndpoint("mail.example.com", endpoint.RecordTypeA, "192.0.2.2"),
+	}}
+	if rec := serveRecords(t, http.MethodPost, changes); rec.Code != http.StatusNoContent {
+		t.Fatalf("POST /records returned %d: %s", rec.Code, rec.Body)
+	}
+	if got := overrideTargets(srv); len(got) != 2 {
+		t.Errorf("stored overrides %v, want 2", got)
+	}
+	if got := srv.Reconfigures("unbound"); got != 1 {
+		t.Errorf("unbound reconfigured %d times, want 1", got)
+	}
+}
@@ -0,0 +1,323 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"slices"
+	"strconv"
+	"strings"
+
+	opnsense "external-dns-opnsense/opnsense"
+
+	"sigs.k8s.io/external-dns/endpoint"
+)
+
+// unboundBackend manages Unbound host overrides and host aliases.
+type unboundBackend struct {
+	api *opnsense.OpnSenseApi
+}
+
+func (b *unboundBackend) List() ([]*endpoint.Endpoint, error) {
+	return ReadUnboundEntries(b.api)
+}
+
+func (b *unboundBackend) Create(ep *endpoint.Endpoint) error {
+	return CreateEntry(b.api, ep)
+}
+
+func (b *unboundBackend) Update(old, ep *endpoint.Endpoint) error {
+	return UpdateEntry(b.api, old, ep)
+}
+
+func (b *unboundBackend) Delete(ep *endpoint.Endpoint) error {
+	return DeleteEntry(b.api, ep)
+}
+
+func (b *unboundBackend) Commit() error {
+	return b.api.Commit("unbound")
+}
+
+// ReadUnboundEntries returns all host overrides and host aliases as endpoints, labeled with
+// the ownership parsed from their descriptions.
+func ReadUnboundEntries(api *opnsense.OpnSenseApi) ([]*endpoint.Endpoint, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), api.ApiTimeout)
+	defer cancel()
+	overrides, err := opnsense.SearchHostOverrides(api.WithContext(ctx), "")
+	if err != nil {
+		log.Printf("List: Error retrieving host overrides: %v\n", err)
+		return nil, err
+	}
+	// Every target is stored as its own override, group them back into one endpoint per name, type and owner
+	endpoints := []*endpoint.Endpoint{}
+	grouped := map[string]*endpoint.Endpoint{}
+	for _, r := range overrides {
+		labels := descriptionLabels(r.Description)
+		key := opnsense.JoinDNSName(r.HostName, r.Domain) + "/" + r.Type + "/" + labels[endpoint.OwnerLabelKey]
+		if ep, ok := grouped[key]; ok {
+			ep.Targets = append(ep.Targets, r.Target())
+			ep.Labels["uuid"] += "," + r.Uuid
+			continue
+		}
+		ttl := int64(0)
+		if r.TTL != "" {
+			ttl, err = strconv.ParseInt(r.TTL, 10, 64)
+			if err != nil {
+				// Do not drop the record on TTL parse error; log and use 0 as TTL
+				log.Printf("Error converting TTL to int for %s.%s: %v. Using TTL=0", r.HostName, r.Domain, err)
+				ttl = 0
+			}
+		}
+
+		labels["uuid"] = r.Uuid
+		ep := &endpoint.Endpoint{
+			DNSName:    opnsense.JoinDNSName(r.HostName, r.Domain),
+			RecordType: r.Type,
+			Targets:    []string{r.Target()},
+			RecordTTL:  endpoint.TTL(ttl),
+			Labels:     labels,
+		}
+		grouped[key] = ep
+		endpoints = append(endpoints, ep)
+	}
+	aliases, err := readAliasEntries(api.WithContext(ctx), overrides)
+	if err != nil {
+		return nil, err
+	}
+	return append(endpoints, aliases...), nil
+}
+
+// readAliasEntries returns the host aliases as CNAME endpoints pointing to the name of their
+// parent, which is looked up in overrides.
+func readAliasEntries(api *opnsense.OpnSenseApi, overrides []*opnsense.OpnSenseHostOverride) ([]*endpoint.Endpoint, error) {
+	aliases, err := opnsense.SearchHostAliases(api, "")
+	if err != nil {
+		log.Printf("List: Error retrieving host aliases: %v\n", err)
+		return nil, err
+	}
+	// Parents are not necessarily owned by us, so resolve them against all overrides
+	parentNames := map[string]string{}
+	for _, p := range overrides {
+		parentNames[p.Uuid] = opnsense.JoinDNSName(p.HostName, p.Domain)
+	}
+
+	endpoints := []*endpoint.Endpoint{}
+	for _, a := range aliases {
+		labels := descriptionLabels(a.Description)
+		target, ok := parentNames[a.Host]
+		if !ok {
+			// Older firmware returns the display value of the parent in search results
+			if err := a.GetByUUID(api); err != nil {
+				log.Printf("List: Error reading host alias %s.%s: %v\n", a.HostName, a.Domain, err)
+				continue
+			}
+			if target, ok = parentNames[a.Host]; !ok {
+				log.Printf("List: Parent of host alias %s.%s not found, skipping\n", a.HostName, a.Domain)
+				continue
+			}
+		}
+		labels["uuid"] = a.Uuid
+		endpoints = append(endpoints, &endpoint.Endpoint{
+			DNSName:    opnsense.JoinDNSName(a.HostName, a.Domain),
+			RecordType: endpoint.RecordTypeCNAME,
+			Targets:    []string{target},
+			Labels:     labels,
+		})
+	}
+	return endpoints, nil
+}
+
+func CreateEntry(api *opnsense.OpnSenseApi, ep *endpoint.Endpoint) error {
+	log.Printf("Creating entry: %s %s %v\n", ep.DNSName, ep.RecordType, ep.Targets)
+	if ep.RecordType == endpoint.RecordTypeCNAME {
+		return CreateAliasEntry(api, ep)
+	}
+	hostname, domain, err := api.SplitDNSName(ep.DNSName)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), api.ApiTimeout)
+	defer cancel()
+	existing, err := FindOverrides(api.WithContext(ctx), hostname, domain, ep.RecordType)
+	if err != nil {
+		log.Printf("CreateEntry: Error searching existing host overrides: %v\n", err)
+		return err
+	}
+
+	// Adding a target to an existing name takes it over as well, so every override of it must be ours to touch
+	for _, found := range existing {
+		if err := api.CheckOwnership(ep.DNSName, found.Description); err != nil {
+			log.Printf("CreateEntry: Refusing to change host overrides: %v\n", err)
+			return err
+		}
+	}
+
+	// Each target is stored as its own host override
+	for _, override := range desiredOverrides(api, hostname, domain, ep) {
+		if found, ok := existing[override.Target()]; ok {
+			log.Printf("CreateEntry: Host override already exists, updating: %+v\n", override)
+			err = override.UpdateChanges(api.WithContext(ctx), found)
+		} else {
+			log.Printf("CreateEntry: Creating host override: %+v\n", override)
+			err = override.Add(api.WithContext(ctx))
+		}
+		if err != nil {
+			log.Printf("CreateEntry: Error creating host override: %v\n", err)
+			return err
+		}
+	}
+
+	return nil
+}
+
+// desiredOverrides returns one host override per target of the endpoint.
+func desiredOverrides(api *opnsense.OpnSenseApi, hostname, domain string, ep *endpoint.Endpoint) []*opnsense.OpnSenseHostOverride {
+	overrides := make([]*opnsense.OpnSenseHostOverride, 0, len(ep.Targets))
+	for _, target := range ep.Targets {
+		override := &opnsense.OpnSenseHostOverride{
+			HostName:    hostname,
+			Domain:      domain,
+			Type:        ep.RecordType,
+			TTL:         strconv.FormatInt(int64(ep.RecordTTL), 10),
+			Enabled:     "1",
+			Description: api.Description(ep.Labels[endpoint.ResourceLabelKey], ep.RecordType),
+		}
+		override.SetTarget(target)
+		overrides = append(overrides, override)
+	}
+	return overrides
+}
+
+// UpdateEntry writes the targets, TTL and description of ep to the host overrides of old,
+// which are looked up by the uuid label of old. Overrides of unchanged targets are kept,
+// overrides of removed targets are reused for added targets, and only differing fields are sent.
+func UpdateEntry(api *opnsense.OpnSenseApi, old, ep *endpoint.Endpoint) error {
+	log.Printf("Updating entry: %s %s %v\n", ep.DNSName, ep.RecordType, ep.Targets)
+	if ep.RecordType == endpoint.RecordTypeCNAME {
+		return UpdateAliasEntry(api, old, ep)
+	}
+	hostname, domain, err := api.SplitDNSName(ep.DNSName)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), api.ApiTimeout)
+	defer cancel()
+	existing, err := currentOverrides(api.WithContext(ctx), old, hostname, domain, ep.RecordType)
+	if err != nil {
+		log.Printf("UpdateEntry: Error finding existing host overrides: %v\n", err)
+		return err
+	}
+	for _, override := range existing {
+		if err := api.CheckOwnership(ep.DNSName, override.Description); err != nil {
+			log.Printf("UpdateEntry: Refusing to update host override: %v\n", err)
+			return err
+		}
+	}
+
+	// Targets already present keep their override, the others are collected for reuse
+	desired := desiredOverrides(api, hostname, domain, ep)
+	unmatched := []*opnsense.OpnSenseHostOverride{}
+	for target, override := range existing {
+		if !slices.ContainsFunc(desired, func(o *opnsense.OpnSenseHostOverride) bool { return o.Target() == target }) {
+			unmatched = append(unmatched, override)
+		}
+	}
+	for _, override := range desired {
+		current, ok := existing[override.Target()]
+		if !ok && len(unmatched) > 0 {
+			current, unmatched = unmatched[0], unmatched[1:]
+			ok = true
+		}
+		if ok {
+			err = override.UpdateChanges(api.WithContext(ctx), current)
+		} else {
+			log.Printf("UpdateEntry: Adding host override for ep target: %+v\n", override)
+			err = override.Add(api.WithContext(ctx))
+		}
+		if err != nil {
+			log.Printf("UpdateEntry: Error updating host override: %v\n", err)
+			return err
+		}
+	}
+	for _, override := range unmatched {
+		log.Printf("UpdateEntry: Deleting host override for removed target: %+v\n", override)
+		if err := override.Delete(api.WithContext(ctx)); err != nil {
+			log.Printf("UpdateEntry: Error deleting host override: %v\n", err)
+			return err
+		}
+	}
+
+	return nil
+}
+
+// currentOverrides returns the host overrides referenced by the uuid label of old, keyed by their target.
+// Overrides that do not belong to the given name and record type are rejected. Without a uuid label,
+// the overrides are searched by name instead.
+func currentOverrides(api *opnsense.OpnSenseApi, old *endpoint.Endpoint, hostname, domain, recordType string) (map[string]*opnsense.OpnSenseHostOverride, error) {
+	if old == nil || old.Labels["uuid"] == "" {
+		return FindOverrides(api, hostname, domain, recordType)
+	}
+	found := map[string]*opnsense.OpnSenseHostOverride{}
+	for _, uuid := range strings.Split(old.Labels["uuid"], ",") {
+		override := &opnsense.OpnSenseHostOverride{Uuid: uuid}
+		if err := override.GetByUUID(api); err != nil {
+			return nil, fmt.Errorf("error reading host override %s: %w", uuid, err)
+		}
+		if override.HostName != hostname || override.Domain != domain || override.Type != recordType {
+			return nil, fmt.Errorf("host override %s is [%s] %s.%s, expected [%s] %s.%s", uuid, override.Type, override.HostName, override.Domain, recordType, hostname, domain)
+		}
+		found[override.Target()] = override
+	}
+	return found, nil
+}
+
+// DeleteEntry deletes the host overrides of the endpoint. These are the overrides listed in its uuid label,
+// or without one, like for the records of the TXT registry, the overrides of its name and type with its targets.
+func DeleteEntry(api *opnsense.OpnSenseApi, ep *endpoint.Endpoint) error {
+	log.Printf("Deleting entry: %s %s %v %v\n", ep.DNSName, ep.RecordType, ep.Targets, ep.Labels)
+	if ep.RecordType == endpoint.RecordTypeCNAME {
+		return DeleteAliasEntry(api, ep)
+	}
+	hostname, domain, err := api.SplitDNSName(ep.DNSName)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), api.ApiTimeout)
+	defer cancel()
+	existing, err := currentOverrides(api.WithContext(ctx), ep, hostname, domain, ep.RecordType)
+	if err != nil {
+		log.Printf("DeleteEntry: Error finding existing host overrides: %v\n", err)
+		return err
+	}
+	for target, override := range existing {
+		if ep.Labels["uuid"] == "" && !slices.Contains(ep.Targets, target) {
+			continue
+		}
+		if err := api.CheckOwnership(ep.DNSName, override.Description); err != nil {
+			log.Printf("DeleteEntry: Refusing to delete host override: %v\n", err)
+			return err
+		}
+
+		log.Printf("DeleteEntry: Deleting host override: %+v\n", override)
+		err = override.Delete(api.WithContext(ctx))
+		if err != nil {
+			log.Printf("DeleteEntry: Error deleting host override: %v\n", err)
+			return err
+		}
+	}
+
+	return nil
+}
+
+// FindOverrides returns the host overrides of the given name and record type, keyed by their target.
+func FindOverrides(api *opnsense.OpnSenseApi, hostname, domain, recordType string) (map[string]*opnsense.OpnSenseHostOverride, error) {
+	overrides, err := opnsense.FindHostOverrides(api, hostname, domain, recordType, "")
+	if err != nil {
+		return nil, fmt.Errorf("FindOverrides: error searching host overrides for %s: %w", opnsense.JoinDNSName(hostname, domain), err)
+	}
+	found := map[string]*opnsense.OpnSenseHostOverride{}
+	for _, o := range overrides {
+		found[o.Target()] = o
+	}
+	return found, nil
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+
+	opnsense "external-dns-opnsense/opnsense"
+	"external-dns-opnsense/opnsense/opnsensetest"
+
+	"sigs.k8s.io/external-dns/endpoint"
+	"sigs.k8s.io/external-dns/plan"
+	"sigs.k8s.io/external-dns/provider"
+	"sigs.k8s.io/external-dns/provider/webhook"
+)
+
+// newWebhookProvider starts the webhook server against a fake OpnSense API managing the records
+// of backend, and connects the webhook client of external-dns to it.
+func newWebhookProvider(t *testing.T, backend string) (*webhook.WebhookProvider, *opnsensetest.Server) {
+	t.Helper()
+	srv := newTestServer(t, backend)
+	api.DNSDomainFilter = []string{"example.com"}
+	webhookServer := httptest.NewServer(webhookHandler())
+	t.Cleanup(webhookServer.Close)
+
+	p, err := webhook.NewWebhookProvider(webhookServer.URL)
+	if err != nil {
+		t.Fatalf("NewWebhookProvider: %v", err)
+	}
+	return p, srv
+}
+
+// recordsByName returns the records of the provider keyed by name and type.
+func recordsByName(t *testing.T, p provider.Provider) map[string]*endpoint.Endpoint {
+	t.Helper()
+	records, err := p.Records(context.Background())
+	if err != nil {
+		t.Fatalf("Records: %v", err)
+	}
+	byName := map[string]*endpoint.Endpoint{}
+	for _, ep := range records {
+		byName[ep.DNSName+" "+ep.RecordType] = ep
+	}
+	return byName
+}
+
+func TestWebhookGetDomainFilter(t *testing.T) {
+	p, _ := newWebhookProvider(t, opnsense.BackendUnbound)
+
+	filter := p.GetDomainFilter()
+	if !filter.Match("www.example.com") {
+		t.Error("domain filter does not match www.example.com")
+	}
+	if filter.Match("www.example.org") {
+		t.Error("domain filter matches www.example.org")
+	}
+}
+
+func TestWebhookAdjustEndpoints(t *testing.T) {
+	p, _ := newWebhookProvider(t, opnsense.BackendUnbound)
+
+	adjusted, err := p.AdjustEndpoints([]*endpoint.Endpoint{
+		endpoint.NewEndpoint("www.example.com", endpoint.RecordTypeA, "192.0.2.1"),
+		endpoint.NewEndpoint("_sip._tcp.example.com", endpoint.RecordTypeSRV, "10 5 5060 sip.example.com"),
+		endpoint.NewEndpoint("example.com", endpoint.RecordTypeMX, "mail.example.com"),
+	})
+	if err != nil {
+		t.Fatalf("AdjustEndpoints: %v", err)
+	}
+	if len(adjusted) != 1 || adjusted[0].DNSName != "www.example.com" {
+		t.Errorf("AdjustEndpoints returned %v, want only www.example.com", adjusted)
+	}
+}
+
+func TestWebhookApplyChanges(t *testing.T) {
+	p, srv := newWebhookProvider(t, opnsense.BackendUnbound)
+	ctx := context.Background()
+
+	err := p.ApplyChanges(ctx, &plan.Changes{Create: []*endpoint.Endpoint{
+		endpoint.NewEndpoint("www.example.com", endpoint.RecordTypeA, "192.0.2.1", "192.0.2.2"),
+		endpoint.NewEndpoint("www.example.com", endpoint.RecordTypeTXT, "\"heritage=external-dns\""),
+		endpoint.NewEndpoint("example.com", endpoint.RecordTypeMX, "10 mail.example.com"),
+		endpoint.NewEndpoint("web.example.com", endpoint.RecordTypeCNAME, "www.example.com"),
+	}})
+	if err != nil {
+		t.Fatalf("ApplyChanges create: %v", err)
+	}
+	if got := srv.Reconfigures("unbound"); got != 1 {
+		t.Errorf("unbound reconfigured %d times, want 1", got)
+	}
+
+	records := recordsByName(t, p)
+	if len(records) != 4 {
+		t.Fatalf("Records returned %d records, want 4: %v", len(records), records)
+	}
+	www := records["www.example.com A"]
+	if www == nil || !slices.Equal(slices.Sorted(slices.Values(www.Targets)), []string{"192.0.2.1", "192.0.2.2"}) {
+		t.Errorf("www.example.com A is %v, want both targets", www)
+	}
+	if www != nil && www.Labels[endpoint.OwnerLabelKey] != api.OwnerID {
+		t.Errorf("www.example.com A is owned by %q, want %q", www.Labels[endpoint.OwnerLabelKey], api.OwnerID)
+	}
+	if cname := records["web.example.com CNAME"]; cname == nil || !slices.Equal(cname.Targets, endpoint.Targets{"www.example.com"}) {
+		t.Errorf("web.example.com CNAME is %v", cname)
+	}
+
+	// Update and delete the records with the endpoints returned by Records, like the controller does
+	updated := www.DeepCopy()
+	updated.Targets = endpoint.Targets{"192.0.2.3"}
+	err = p.ApplyChanges(ctx, &plan.Changes{
+		UpdateOld: []*endpoint.Endpoint{www},
+		UpdateNew: []*endpoint.Endpoint{updated},
+		Delete:    []*endpoint.Endpoint{records["example.com MX"]},
+	})
+	if err != nil {
+		t.Fatalf("ApplyChanges update: %v", err)
+	}
+
+	records = recordsByName(t, p)
+	if _, ok := records["example.com MX"]; ok {
+		t.Error("example.com MX still exists after its deletion")
+	}
+	if www := records["www.example.com A"]; www == nil || !slices.Equal(www.Targets, endpoint.Targets{"192.0.2.3"}) {
+		t.Errorf("www.example.com A is %v after the update, want 192.0.2.3", www)
+	}
+}
+
+func TestWebhookSoftErrors(t *testing.T) {
+	p, srv := newWebhookProvider(t, opnsense.BackendUnbound)
+	srv.Inject(opnsensetest.Fault{Status: http.StatusBadGateway})
+
+	// Failures of the firewall must be retried by the controller in its next sync
+	if _, err := p.Records(context.Background()); !errors.Is(err, provider.SoftError) {
+		t.Errorf("Records returned %v, want a soft error", err)
+	}
+	changes := &plan.Changes{Create: []*endpoint.Endpoint{endpoint.NewEndpoint("www.example.com", endpoint.RecordTypeA, "192.0.2.1")}}
+	if err := p.ApplyChanges(context.Background(), changes); !errors.Is(err, provider.SoftError) {
+		t.Errorf("ApplyChanges returned %v, want a soft error", err)
+	}
+}
+
+func TestWebhookMXRoundTrip(t *testing.T) {
+	p, _ := newWebhookProvider(t, opnsense.BackendUnbound)
+	ctx := context.Background()
+
+	// Sources commonly write the exchange fully qualified, the firewall stores it without the dot
+	desired, err := p.AdjustEndpoints([]*endpoint.Endpoint{
+		endpoint.NewEndpoint("example.com", endpoint.RecordTypeMX, "010 mail.example.com.", "20 backup.example.com"),
+	})
+	if err != nil || len(desired) != 1 {
+		t.Fatalf("AdjustEndpoints returned %v, %v", desired, err)
+	}
+	if err := p.ApplyChanges(ctx, &plan.Changes{Create: desired}); err != nil {
+		t.Fatalf("ApplyChanges: %v", err)
+	}
+
+	mx := recordsByName(t, p)["example.com MX"]
+	if mx == nil {
+		t.Fatal("example.com MX was not listed")
+	}
+	if !mx.Targets.Same(desired[0].Targets) {
+		t.Errorf("listed targets %v differ from the adjusted targets %v, the record would be updated on every sync", mx.Targets, desired[0].Targets)
+	}
+}
+
+func TestWebhookDeleteWithoutLabels(t *testing.T) {
+	p, srv := newWebhookProvider(t, opnsense.BackendUnbound)
+	ctx := context.Background()
+
+	created := []*endpoint.Endpoint{
+		endpoint.NewEndpoint("www.example.com", endpoint.RecordTypeA, "192.0.2.1", "192.0.2.2"),
+		endpoint.NewEndpoint("a-www.example.com", endpoint.RecordTypeTXT, "\"heritage=external-dns,external-dns/owner=default\""),
+	}
+	if err := p.ApplyChanges(ctx, &plan.Changes{Create: created}); err != nil {
+		t.Fatalf("ApplyChanges create: %v", err)
+	}
+
+	// The TXT registry deletes its records with freshly built endpoints, which carry no uuid label
+	deleted := []*endpoint.Endpoint{
+		endpoint.NewEndpoint("www.example.com", endpoint.RecordTypeA, "192.0.2.1", "192.0.2.2"),
+		endpoint.NewEndpoint("a-www.example.com", endpoint.RecordTypeTXT, "\"heritage=external-dns,external-dns/owner=default\""),
+	}
+	if err := p.ApplyChanges(ctx, &plan.Changes{Delete: deleted}); err != nil {
+		t.Fatalf("ApplyChanges delete: %v", err)
+	}
+	if overrides := overrideTargets(srv); len(overrides) != 0 {
+		t.Errorf("host overrides %v remain after their deletion", overrides)
+	}
+}